@@ -0,0 +1,451 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type ArchiveFormat string
+
+const (
+	ZipArchive   ArchiveFormat = "zip"
+	TarGzArchive ArchiveFormat = "tar.gz"
+)
+
+// What to do when an entry of an imported archive already exists in the workspace
+type OverwritePolicy string
+
+const (
+	OverwriteFail    OverwritePolicy = "fail"
+	OverwriteSkip    OverwritePolicy = "skip"
+	OverwriteReplace OverwritePolicy = "overwrite"
+)
+
+func parseArchiveFormat(value string) (ArchiveFormat, error) {
+	switch value {
+	case "", "zip":
+		return ZipArchive, nil
+	case "tar.gz", "tgz":
+		return TarGzArchive, nil
+	}
+	return "", fmt.Errorf("Unsupported archive format %q, must be zip or tar.gz", value)
+}
+
+// exportArchiveHandler streams a zip or tar.gz of a workspace directory. Ignored paths such as
+// node_modules are left out and symlinks are skipped so nothing outside the workspace can sneak in.
+func exportArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	format, err := parseArchiveFormat(queryParams.Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := resolveWorkspacePath(queryParams.Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	if exists, err := directoryExists(dir); err != nil || !exists {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		http.Error(w, "Failed to load ignore rules", http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(dir)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+
+	// Once the first byte is out the status is committed, so from here on errors can only be logged.
+	switch format {
+	case ZipArchive:
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZipArchive(w, dir, ignore)
+	case TarGzArchive:
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeTarGzArchive(w, dir, ignore)
+	}
+	if err != nil {
+		log.Printf("Failed to write %s archive of %s: %v", format, dir, err)
+	}
+}
+
+// walkArchiveFiles calls fn for every regular file and directory under root that isn't ignored, with
+// a slash separated path relative to root.
+func walkArchiveFiles(root string, ignore *ignoreMatcher, fn func(path string, rel string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if ignore != nil && ignore.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(rel), info)
+	})
+}
+
+func writeZipArchive(out io.Writer, root string, ignore *ignoreMatcher) error {
+	archive := zip.NewWriter(out)
+
+	err := walkArchiveFiles(root, ignore, func(path string, rel string, info fs.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+
+		writer, err := archive.CreateHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return copyFileTo(writer, path)
+	})
+	if err != nil {
+		archive.Close()
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeTarGzArchive(out io.Writer, root string, ignore *ignoreMatcher) error {
+	compressed := gzip.NewWriter(out)
+	archive := tar.NewWriter(compressed)
+
+	err := walkArchiveFiles(root, ignore, func(path string, rel string, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := archive.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+		return copyFileTo(archive, path)
+	})
+	if err != nil {
+		archive.Close()
+		compressed.Close()
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func copyFileTo(out io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(out, file)
+	return err
+}
+
+// archiveEntry is a format independent view of a single file or directory in an uploaded archive.
+type archiveEntry struct {
+	name  string
+	mode  os.FileMode
+	isDir bool
+	size  int64
+	open  func() (io.ReadCloser, error)
+}
+
+// forEachArchiveEntry iterates over the regular files and directories of the archive at path. Symlinks,
+// devices and anything else are skipped.
+func forEachArchiveEntry(path string, format ArchiveFormat, fn func(entry *archiveEntry) error) error {
+	switch format {
+	case ZipArchive:
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		for _, file := range archive.File {
+			file := file
+			mode := file.Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			err := fn(&archiveEntry{
+				name:  file.Name,
+				mode:  mode,
+				isDir: mode.IsDir(),
+				size:  int64(file.UncompressedSize64),
+				open:  func() (io.ReadCloser, error) { return file.Open() },
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case TarGzArchive:
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		compressed, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		archive := tar.NewReader(compressed)
+
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+				continue
+			}
+			err = fn(&archiveEntry{
+				name:  header.Name,
+				mode:  header.FileInfo().Mode(),
+				isDir: header.Typeflag == tar.TypeDir,
+				size:  header.Size,
+				open:  func() (io.ReadCloser, error) { return io.NopCloser(archive), nil },
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported archive format %q", format)
+}
+
+type ImportArchiveResponse struct {
+	Extracted []string `json:"extracted"`
+	Skipped   []string `json:"skipped"`
+}
+
+type ImportConflictResponse struct {
+	Message   string   `json:"message"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// resolveArchiveEntry returns where an entry gets extracted to. Nothing is ever extracted into a .git
+// directory, an archive could otherwise plant hooks or rewrite the repository's config.
+func resolveArchiveEntry(root string, target string, name string) (string, error) {
+	dest, err := resolvePathInRoot(target, filepath.FromSlash(name))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, dest)
+	if err != nil {
+		return "", err
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.EqualFold(part, ".git") {
+			return "", &WorkspacePathError{Path: name, Reason: "extracting into .git is not allowed"}
+		}
+	}
+	return dest, nil
+}
+
+// importArchiveHandler unpacks the archive in the request body into a workspace directory. Every entry is
+// resolved with the same rules as any other client supplied path, so a "zip slip" entry like
+// ../../.config/gcloud/keys.json or a path through a symlink rejects the whole import.
+func importArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	format, err := parseArchiveFormat(queryParams.Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	policy := OverwritePolicy(queryParams.Get("overwrite"))
+	if policy == "" {
+		policy = OverwriteFail
+	}
+	if policy != OverwriteFail && policy != OverwriteSkip && policy != OverwriteReplace {
+		http.Error(w, "Param overwrite must be one of fail, skip or overwrite", http.StatusBadRequest)
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+	target, err := resolvePathInRoot(root, workspaceRelativePath(root, queryParams.Get("path")))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	// zip needs random access, so spool the body to disk first. tar.gz gets the same treatment so the
+	// conflict check can read the archive twice.
+	uploads, err := uploadsDir()
+	if err != nil {
+		http.Error(w, "Failed to create upload directory", http.StatusInternalServerError)
+		return
+	}
+
+	spool, err := os.CreateTemp(uploads, "import-*")
+	if err != nil {
+		http.Error(w, "Failed to store archive", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spool.Name())
+
+	maxBytes := maxUploadBytes()
+	size, err := io.Copy(spool, io.LimitReader(r.Body, maxBytes+1))
+	spool.Close()
+	if err != nil {
+		http.Error(w, "Failed to read archive", http.StatusBadRequest)
+		return
+	}
+	if size > maxBytes {
+		http.Error(w, fmt.Sprintf("Archive exceeds the maximum of %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// First pass: validate every path and look for conflicts before anything is written.
+	var conflicts []string
+	var totalSize int64
+	err = forEachArchiveEntry(spool.Name(), format, func(entry *archiveEntry) error {
+		dest, err := resolveArchiveEntry(root, target, entry.name)
+		if err != nil {
+			return err
+		}
+
+		totalSize += entry.size
+		if totalSize > maxBytes {
+			return fmt.Errorf("archive expands to more than the maximum of %d bytes", maxBytes)
+		}
+
+		if !entry.isDir && fileExists(dest) {
+			conflicts = append(conflicts, dest)
+		}
+		return nil
+	})
+	if err != nil {
+		var pathErr *WorkspacePathError
+		if errors.As(err, &pathErr) {
+			writeWorkspacePathError(w, err)
+			return
+		}
+		http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(conflicts) > 0 && policy == OverwriteFail {
+		WriteJSONResponseWithHeader(w, http.StatusConflict, &ImportConflictResponse{
+			Message:   "Archive would overwrite existing files",
+			Conflicts: conflicts,
+		})
+		return
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	response := &ImportArchiveResponse{Extracted: []string{}, Skipped: []string{}}
+	err = forEachArchiveEntry(spool.Name(), format, func(entry *archiveEntry) error {
+		dest, err := resolveArchiveEntry(root, target, entry.name)
+		if err != nil {
+			return err
+		}
+
+		if entry.isDir {
+			return os.MkdirAll(dest, 0755)
+		}
+
+		if fileExists(dest) && policy == OverwriteSkip {
+			response.Skipped = append(response.Skipped, dest)
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		snapshotBeforeWrite(dest)
+
+		src, err := entry.open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.mode.Perm()|0600)
+		if err != nil {
+			return err
+		}
+
+		// Never trust the sizes in the headers, a crafted archive can claim less than it contains.
+		_, err = io.Copy(out, io.LimitReader(src, entry.size))
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		recordFileFromDisk(dest, HistoryImport)
+
+		response.Extracted = append(response.Extracted, dest)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to import archive into %s: %v", target, err)
+		http.Error(w, "Failed to extract archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, response)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResolveArchiveEntry(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "vendor", "lib"), 0755))
+
+	dest, err := resolveArchiveEntry(root, root, "src/.gitignore")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "src", ".gitignore"), dest)
+
+	cases := []struct {
+		target string
+		name   string
+	}{
+		{root, ".git/hooks/pre-commit"},
+		{root, "src/.GIT/config"},
+		{filepath.Join(root, "vendor"), "lib/.git/config"},
+		{filepath.Join(root, ".git"), "hooks/post-checkout"},
+	}
+	for _, c := range cases {
+		_, err := resolveArchiveEntry(root, c.target, c.name)
+		var pathErr *WorkspacePathError
+		assert.True(t, errors.As(err, &pathErr), c.name)
+	}
+}
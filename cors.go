@@ -7,7 +7,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Trash-Id")
 
 		// if it's just an OPTIONS request, respond only with headers, no further processing needed
 		if r.Method == "OPTIONS" {
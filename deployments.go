@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	DEFAULT_DEPLOYMENTS_LIMIT = 50
+	MAX_DEPLOYMENTS_LIMIT     = 500
+)
+
+type DeploymentKind string
+
+const (
+	DeploymentPush     DeploymentKind = "push"
+	DeploymentRollback DeploymentKind = "rollback"
+)
+
+type DeploymentFileStat struct {
+	Path      string `json:"path"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary"`
+}
+
+// DeploymentDiffStat summarizes what changed in release compared to the previous deployment.
+type DeploymentDiffStat struct {
+	FilesChanged int                   `json:"filesChanged"`
+	Additions    int                   `json:"additions"`
+	Deletions    int                   `json:"deletions"`
+	Files        []*DeploymentFileStat `json:"files,omitempty"`
+}
+
+// Deployment is one entry of the ledger in $HOME/.fermat/deployments/ledger.jsonl. Entries are only ever
+// appended, one JSON object per line.
+type Deployment struct {
+	ID         int                  `json:"id"`
+	Kind       DeploymentKind       `json:"kind"`
+	StartedAt  time.Time            `json:"startedAt"`
+	FinishedAt time.Time            `json:"finishedAt"`
+	Status     PushProductionStatus `json:"status"`
+	Message    string               `json:"message,omitempty"`
+	Commit     string               `json:"commit,omitempty"`
+	// Previous is the commit release pointed at before the deployment
+	Previous    string `json:"previous,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	TriggeredBy string `json:"triggeredBy,omitempty"`
+	// DiffStat is left out when it's unknown, e.g. because release couldn't be fetched beforehand
+	DiffStat *DeploymentDiffStat `json:"diffStat,omitempty"`
+	// ChecksSkipped is set when the pre-deploy checks were overridden
+	ChecksSkipped bool                    `json:"checksSkipped,omitempty"`
+	Checks        []*PredeployCheckResult `json:"checks,omitempty"`
+}
+
+// deploymentsLock guards appending to the ledger so IDs stay unique.
+var deploymentsLock sync.Mutex
+
+func deploymentLedgerPath() (string, error) {
+	dir, err := fermatStateDir("deployments")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ledger.jsonl"), nil
+}
+
+// readDeploymentsLocked returns every deployment in the ledger, oldest first. Lines that can't be parsed
+// (e.g. cut short by a crash) are skipped.
+func readDeploymentsLocked() ([]*Deployment, error) {
+	path, err := deploymentLedgerPath()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]*Deployment, 0), nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	deployments := make([]*Deployment, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		deployment := &Deployment{}
+		if err := json.Unmarshal([]byte(line), deployment); err != nil {
+			log.Println("Skipping unreadable deployment ledger entry", err.Error())
+			continue
+		}
+		deployments = append(deployments, deployment)
+	}
+	return deployments, scanner.Err()
+}
+
+// recordDeployment appends a deployment to the ledger and assigns its ID. Failures are only logged, the
+// deployment itself already happened.
+func recordDeployment(deployment *Deployment) {
+	deploymentsLock.Lock()
+	defer deploymentsLock.Unlock()
+
+	if err := recordDeploymentLocked(deployment); err != nil {
+		log.Printf("[Error] Failed to record deployment of %s: %v", deployment.Commit, err)
+	}
+}
+
+func recordDeploymentLocked(deployment *Deployment) error {
+	deployments, err := readDeploymentsLocked()
+	if err != nil {
+		return err
+	}
+	deployment.ID = 1
+	if len(deployments) > 0 {
+		deployment.ID = deployments[len(deployments)-1].ID + 1
+	}
+
+	data, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+
+	path, err := deploymentLedgerPath()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	// A crash mid-write leaves a line without its newline, start a fresh line so only that entry is lost
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// deploymentTag is the tag a deployment's commit gets, e.g. deploy-20240102-150405.
+func deploymentTag(kind DeploymentKind, at time.Time) string {
+	prefix := "deploy"
+	if kind == DeploymentRollback {
+		prefix = "rollback"
+	}
+	return prefix + "-" + at.UTC().Format("20060102-150405")
+}
+
+// releaseHead returns the commit origin/release points at after fetching it, or "" when there's no
+// release yet. It fails when the fetch does, a stale origin/release would make the diffstat lie.
+func releaseHead(root string) (string, error) {
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "fetch", "origin", "release")
+	if runner.err != nil {
+		if strings.Contains(runner.output, "couldn't find remote ref") {
+			return "", nil
+		}
+		return "", runner.err
+	}
+
+	runner.Run("git", "rev-parse", "--verify", "--quiet", "refs/remotes/origin/release")
+	if runner.err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(runner.output), nil
+}
+
+// deploymentDiffStat compares two commits like `git diff --numstat`. An empty from counts everything in
+// to as added.
+func deploymentDiffStat(root string, from string, to string) (*DeploymentDiffStat, error) {
+	if from == "" {
+		// The empty tree
+		from = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	}
+
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "diff", "--numstat", "--no-renames", "-z", from, to)
+	if runner.err != nil {
+		return nil, runner.err
+	}
+
+	stat := &DeploymentDiffStat{Files: make([]*DeploymentFileStat, 0)}
+	for _, record := range strings.Split(runner.output, "\x00") {
+		fields := strings.SplitN(record, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		file := &DeploymentFileStat{Path: fields[2]}
+		if fields[0] == "-" {
+			file.Binary = true
+		} else {
+			file.Additions, _ = strconv.Atoi(fields[0])
+			file.Deletions, _ = strconv.Atoi(fields[1])
+		}
+		stat.Additions += file.Additions
+		stat.Deletions += file.Deletions
+		stat.Files = append(stat.Files, file)
+	}
+	stat.FilesChanged = len(stat.Files)
+	return stat, nil
+}
+
+// tagDeployment tags commit locally. The tag is meant to be pushed in the same atomic push as release,
+// so it only exists on origin when release actually moved; untagDeployment drops it when that push fails.
+func tagDeployment(runner *CommandRunner, kind DeploymentKind, commit string, message string, at time.Time) (string, error) {
+	tag := deploymentTag(kind, at)
+	// Two deployments within the same second get a suffix rather than fail
+	for n := 2; ; n++ {
+		check := &CommandRunner{dir: runner.dir}
+		check.Run("git", "rev-parse", "--verify", "--quiet", "refs/tags/"+tag)
+		if check.err != nil {
+			break
+		}
+		tag = fmt.Sprintf("%s-%d", deploymentTag(kind, at), n)
+	}
+
+	runner.Run("git", "tag", "-a", tag, "-m", message, commit)
+	return tag, runner.err
+}
+
+// untagDeployment drops a tag whose push failed so retrying doesn't leave stale tags behind.
+func untagDeployment(root string, tag string) {
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "tag", "-d", tag)
+	if runner.err != nil {
+		log.Println("Failed to remove deployment tag", tag, runner.err.Error())
+	}
+}
+
+// listDeploymentsHandler returns the ledger newest first, paged with offset and limit. The per-file
+// diffstat and the output of the checks are left out, they're part of the single deployment.
+func listDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	offset, limit := 0, DEFAULT_DEPLOYMENTS_LIMIT
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Param offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > MAX_DEPLOYMENTS_LIMIT {
+			http.Error(w, "Param limit must be between 1 and "+strconv.Itoa(MAX_DEPLOYMENTS_LIMIT), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	deploymentsLock.Lock()
+	deployments, err := readDeploymentsLocked()
+	deploymentsLock.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to read deployments", http.StatusInternalServerError)
+		return
+	}
+
+	page := make([]*Deployment, 0, limit)
+	for i := len(deployments) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		deployment := *deployments[i]
+		if deployment.DiffStat != nil {
+			stat := *deployment.DiffStat
+			stat.Files = nil
+			deployment.DiffStat = &stat
+		}
+		checks := make([]*PredeployCheckResult, 0, len(deployment.Checks))
+		for _, check := range deployment.Checks {
+			summary := *check
+			summary.Output = ""
+			summary.Findings = nil
+			checks = append(checks, &summary)
+		}
+		deployment.Checks = checks
+		page = append(page, &deployment)
+	}
+
+	WriteJSONResponse(w, page)
+}
+
+func getDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Deployment not found", http.StatusNotFound)
+		return
+	}
+
+	deploymentsLock.Lock()
+	deployments, err := readDeploymentsLocked()
+	deploymentsLock.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to read deployments", http.StatusInternalServerError)
+		return
+	}
+
+	for _, deployment := range deployments {
+		if deployment.ID == id {
+			WriteJSONResponse(w, deployment)
+			return
+		}
+	}
+	http.Error(w, "Deployment not found", http.StatusNotFound)
+}
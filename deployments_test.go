@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DeploymentLedger(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	recordDeployment(&Deployment{Kind: DeploymentPush, Status: BuildTriggered, Commit: "a"})
+
+	// A line cut short by a crash doesn't break the ledger
+	path, err := deploymentLedgerPath()
+	assert.Nil(t, err)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	file.WriteString("{\"id\":2,\"kind")
+	file.Close()
+
+	recordDeployment(&Deployment{Kind: DeploymentRollback, Status: BuildTriggered, Commit: "b"})
+
+	deployments, err := readDeploymentsLocked()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deployments))
+	assert.Equal(t, 1, deployments[0].ID)
+	assert.Equal(t, "a", deployments[0].Commit)
+	assert.Equal(t, 2, deployments[1].ID)
+	assert.Equal(t, DeploymentRollback, deployments[1].Kind)
+}
+
+func Test_TagDeploymentSameSecond(t *testing.T) {
+	root := initTestRepo(t)
+	at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	runner := &CommandRunner{dir: root}
+	tag, err := tagDeployment(runner, DeploymentPush, "HEAD", "first", at)
+	assert.Nil(t, err)
+	assert.Equal(t, "deploy-20240102-150405", tag)
+
+	tag, err = tagDeployment(runner, DeploymentPush, "HEAD", "second", at)
+	assert.Nil(t, err)
+	assert.Equal(t, "deploy-20240102-150405-2", tag)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fileWriteLock serializes the "check version then write" sequence for every write that goes through
+// fermat so two requests can't both pass the same If-Match precondition.
+var fileWriteLock sync.Mutex
+
+// contentETag returns the quoted strong ETag for the given file content.
+func contentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// fileETag hashes the file at path. A file that doesn't exist has an empty ETag and no error.
+func fileETag(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+
+	return readerETag(file)
+}
+
+// readerETag hashes everything left in r, for callers that already have the file open.
+func readerETag(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches implements the If-Match comparison. "*" matches any existing file and the header may
+// carry a comma separated list of tags. A weak prefix is tolerated since proxies like to add one.
+func etagMatches(ifMatch string, current string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" && current != "" {
+			return true
+		}
+		if candidate != "" && candidate == current {
+			return true
+		}
+	}
+	return false
+}
+
+// FileVersionResponse is returned by endpoints that write a file, carrying the ETag of the new content.
+type FileVersionResponse struct {
+	ETag string `json:"etag"`
+	Size int    `json:"size"`
+}
+
+type FileConflictResponse struct {
+	Message string `json:"message"`
+	ETag    string `json:"etag"`
+	Exists  bool   `json:"exists"`
+	Content string `json:"content"`
+}
+
+// writeFileConflict answers a failed precondition with a 409 carrying whatever is on disk right now so
+// the editor can show a merge view instead of clobbering the other change.
+func writeFileConflict(w http.ResponseWriter, path string) {
+	response := &FileConflictResponse{Message: "File was modified since it was last read"}
+
+	content, err := os.ReadFile(path)
+	if err == nil {
+		response.Exists = true
+		response.ETag = contentETag(content)
+		response.Content = string(content)
+		w.Header().Set("ETag", response.ETag)
+	}
+
+	WriteJSONResponseWithHeader(w, http.StatusConflict, response)
+}
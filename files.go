@@ -1,71 +1,200 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"time"
+	"unicode/utf8"
 )
 
 type File struct {
-	Name     string  `json:"name"`
-	Path     string  `json:"path"`
-	IsDir    bool    `json:"isDir"`
-	Children []*File `json:"children,omitempty"`
+	Name          string    `json:"name"`
+	Path          string    `json:"path"`
+	IsDir         bool      `json:"isDir"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"modTime"`
+	Mode          string    `json:"mode"`
+	SymlinkTarget string    `json:"symlinkTarget,omitempty"`
+	MimeType      string    `json:"mimeType,omitempty"`
+	Children      []*File   `json:"children,omitempty"`
+	// Truncated is set on directories whose children weren't listed because the depth limit was reached
+	// or because only a page of them was returned.
+	Truncated bool `json:"truncated,omitempty"`
+	// TotalChildren is the number of (non-ignored) entries in a directory before pagination.
+	TotalChildren int `json:"totalChildren,omitempty"`
 }
 
-func listDir(root string) (*File, error) {
-	info, err := os.Stat(root)
+type listOptions struct {
+	// Depth is how many levels of children to include. A negative depth lists the whole tree.
+	Depth int
+	// Offset and Limit paginate the children of the directory being listed. A zero Limit means no limit.
+	Offset int
+	Limit  int
+	Ignore *ignoreMatcher
+}
+
+func listDir(root string, opts listOptions) (*File, error) {
+	info, err := os.Lstat(root)
 	if err != nil {
 		return nil, err
 	}
 
 	file := &File{
-		Name:  info.Name(),
-		Path:  root,
-		IsDir: info.IsDir(),
+		Name:    info.Name(),
+		Path:    root,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().String(),
 	}
 
-	if info.IsDir() {
-		files, err := os.ReadDir(root)
-		if err != nil {
-			return nil, err
+	// Report symlinks with their target but never follow them into a directory, that's both a way out
+	// of the workspace and a way into an infinite loop.
+	if info.Mode()&os.ModeSymlink != 0 {
+		file.SymlinkTarget, _ = os.Readlink(root)
+		if target, err := os.Stat(root); err == nil && !target.IsDir() {
+			file.Size = target.Size()
+			file.MimeType = detectMimeType(root)
 		}
+		return file, nil
+	}
 
-		children := make([]*File, 0)
-		for _, f := range files {
-			fullPath := filepath.Join(root, f.Name())
-			if strings.Contains(fullPath, "node_modules") {
-				continue
-			}
+	if !info.IsDir() {
+		file.MimeType = detectMimeType(root)
+		return file, nil
+	}
+
+	if opts.Depth == 0 {
+		file.Truncated = true
+		return file, nil
+	}
 
-			child, err := listDir(filepath.Join(root, f.Name()))
-			if err != nil {
-				return nil, err
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]os.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if opts.Ignore != nil && opts.Ignore.Match(filepath.Join(root, entry.Name()), entry.IsDir()) {
+			continue
+		}
+		visible = append(visible, entry)
+	}
+	file.TotalChildren = len(visible)
+
+	if opts.Offset > 0 || opts.Limit > 0 {
+		start := opts.Offset
+		if start > len(visible) {
+			start = len(visible)
+		}
+		end := len(visible)
+		if opts.Limit > 0 && start+opts.Limit < end {
+			end = start + opts.Limit
+		}
+		file.Truncated = start > 0 || end < len(visible)
+		visible = visible[start:end]
+	}
+
+	// Pagination only applies to the directory being listed, not to its descendants.
+	childOpts := listOptions{Depth: opts.Depth - 1, Ignore: opts.Ignore}
+	children := make([]*File, 0, len(visible))
+	for _, entry := range visible {
+		child, err := listDir(filepath.Join(root, entry.Name()), childOpts)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted while we were listing
+				continue
 			}
-			children = append(children, child)
+			return nil, err
 		}
-		file.Children = children
+		children = append(children, child)
 	}
+	file.Children = children
 
 	return file, nil
 }
 
+// detectMimeType guesses a file's MIME type from its extension and falls back to sniffing the first
+// 512 bytes when the extension is unknown.
+func detectMimeType(path string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	if err != nil && err != io.EOF {
+		return ""
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// isBinaryContent uses the same heuristic as git: a NUL byte in the first 8000 bytes means binary. Text
+// that isn't valid UTF-8 is treated as binary too since nothing downstream can render it.
+func isBinaryContent(content []byte) bool {
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(content)
+}
+
+// parseListOptions reads the depth, offset and limit query parameters. Without a depth the whole tree
+// is returned like it always has been.
+func parseListOptions(r *http.Request) (listOptions, error) {
+	opts := listOptions{Depth: -1}
+	queryParams := r.URL.Query()
+
+	for name, target := range map[string]*int{"depth": &opts.Depth, "offset": &opts.Offset, "limit": &opts.Limit} {
+		value := queryParams.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return opts, fmt.Errorf("Param %s must be a non-negative integer", name)
+		}
+		*target = parsed
+	}
+
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		return opts, err
+	}
+	opts.Ignore = ignore
+
+	return opts, nil
+}
+
 func getFileList(w http.ResponseWriter, r *http.Request) {
-	home, ok := os.LookupEnv("HOME")
-	if !ok {
-		http.Error(w, "HOME environment variable not found", http.StatusInternalServerError)
+	root, err := resolveWorkspacePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
 		return
 	}
 
-	filePathFromQueryString := r.URL.Query().Get("path")
+	opts, err := parseListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	root := filepath.Join(home, "code"+filePathFromQueryString)
-	result, err := listDir(root)
+	result, err := listDir(root, opts)
 
 	if err != nil {
 		//directory may not exist, return empty directory instead of an error
@@ -89,9 +218,32 @@ func deleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := r.URL.Query().Get("path")
+	path, err := resolveWorkspacePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
 
-	err := os.RemoveAll(path)
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to resolve workspace", http.StatusInternalServerError)
+		return
+	}
+	if path == root {
+		http.Error(w, "Can't delete the workspace root", http.StatusForbidden)
+		return
+	}
+
+	// Deletes go to the trash so a mis-click can be undone. permanent=true skips the trash entirely.
+	if r.URL.Query().Get("permanent") == "true" {
+		err = os.RemoveAll(path)
+	} else {
+		var entry *TrashEntry
+		entry, err = moveToTrash(path)
+		if err == nil {
+			w.Header().Set("X-Trash-Id", entry.ID)
+		}
+	}
 	if err != nil {
 		fmt.Printf(err.Error())
 		http.Error(w, "Failed to delete file "+err.Error(), http.StatusInternalServerError)
@@ -109,22 +261,23 @@ func fileContents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := r.URL.Query().Get("path")
+	path, err := resolveWorkspacePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
 
-	file, err := os.Open(path)
+	// Read the file once so the ETag always describes exactly the bytes we send back.
+	content, err := os.ReadFile(path)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusNotFound)
 		return
 	}
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Printf("Failed to close file: %v", cerr)
-		}
-	}()
+	w.Header().Set("ETag", contentETag(content))
 
-	_, err = io.Copy(w, file)
+	_, err = w.Write(content)
 	if err != nil {
-		http.Error(w, "Failed to write file content", http.StatusInternalServerError)
+		log.Printf("Failed to write file content: %v", err)
 	}
 }
 
@@ -148,37 +301,45 @@ func writeCodeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	home, err := os.UserHomeDir()
+	path, err := resolveWorkspacePath(req.Path)
 	if err != nil {
-		http.Error(w, "Can't get user's home directory", http.StatusInternalServerError)
+		writeWorkspacePathError(w, err)
 		return
 	}
 
-	path := filepath.Join(home, "code", req.Path)
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
 
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	if err != nil {
-		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
-		return
+	// Optional optimistic concurrency: the editor sends back the ETag it got from /code/file_contents and
+	// we refuse the write if someone (another tab, nodemon, npm...) changed the file in the meantime.
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		current, err := fileETag(path)
+		if err != nil {
+			http.Error(w, "Failed to read current file", http.StatusInternalServerError)
+			return
+		}
+		if !etagMatches(ifMatch, current) {
+			writeFileConflict(w, path)
+			return
+		}
 	}
 
-	file, err := os.Create(path) // Create the file (or overwrite if it exists)
+	snapshotBeforeWrite(path)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
 		return
 	}
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Printf("Failed to close file: %v", cerr)
-		}
-	}()
 
-	_, err = file.WriteString(req.Content)
+	err = writeFileAtomic(path, []byte(req.Content))
 	if err != nil {
 		http.Error(w, "Failed to write to file", http.StatusInternalServerError)
 		return
 	}
+	recordFileRevision(path, []byte(req.Content), HistoryWrite)
 
+	w.Header().Set("ETag", contentETag([]byte(req.Content)))
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("File written successfully!"))
 	return
@@ -205,13 +366,17 @@ func writeAnyFile(w http.ResponseWriter, r *http.Request) {
 		dirPath = filepath.Join("frontend", "public")
 	}
 
-	home, err := os.UserHomeDir()
+	path, err := resolveWorkspacePath(filepath.Join(dirPath, filepath.Base(handler.Filename)))
 	if err != nil {
-		http.Error(w, "Can't get user's home directory", http.StatusInternalServerError)
+		writeWorkspacePathError(w, err)
 		return
 	}
 
-	path := filepath.Join(home, "code", dirPath, filepath.Base(handler.Filename))
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	snapshotBeforeWrite(path)
+
 	err = os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
@@ -230,12 +395,128 @@ func writeAnyFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to write to file", http.StatusInternalServerError)
 		return
 	}
+	recordFileFromDisk(path, HistoryUpload)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("File uploaded successfully!"))
 	return
 }
 
+type MoveFileRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+func moveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	var req MoveFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.From == "" || req.To == "" {
+		http.Error(w, "Both from and to must be specified", http.StatusBadRequest)
+		return
+	}
+
+	from, err := resolveWorkspacePath(req.From)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	to, err := resolveWorkspacePath(req.To)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to resolve workspace", http.StatusInternalServerError)
+		return
+	}
+	if from == root || to == root {
+		http.Error(w, "Can't move the workspace root", http.StatusForbidden)
+		return
+	}
+
+	if from == to {
+		http.Error(w, "Source and destination are the same", http.StatusBadRequest)
+		return
+	}
+
+	if isWithinDir(from, to) {
+		http.Error(w, "Can't move a directory inside of itself", http.StatusBadRequest)
+		return
+	}
+
+	// Held from checking the destination until the rename, so a write through fermat can't show up at the
+	// destination in between and get replaced without going to the trash
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	if _, err := os.Lstat(from); err != nil {
+		http.Error(w, "Source doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	// An overwritten destination goes to the trash like any other delete, so it can be recovered
+	var replaced *TrashEntry
+	if _, err := os.Lstat(to); err == nil {
+		if !req.Overwrite {
+			http.Error(w, "Destination already exists", http.StatusConflict)
+			return
+		}
+
+		replaced, err = moveToTrash(to)
+		if err != nil {
+			http.Error(w, "Failed to move existing destination to the trash: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		log.Printf("Failed to move %s to %s: %v", from, to, err)
+		if replaced != nil {
+			if err := restoreFromTrash(replaced); err != nil {
+				log.Printf("[Error] Failed to put %s back from the trash: %v", to, err)
+			}
+		}
+		http.Error(w, "Failed to move file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if replaced != nil {
+		w.Header().Set("X-Trash-Id", replaced.ID)
+	}
+
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		http.Error(w, "Failed to load ignore rules", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := listDir(to, listOptions{Depth: -1, Ignore: ignore})
+	if err != nil {
+		http.Error(w, "Moved file but failed to read it back: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, result)
+}
+
 func packageJSONReact(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Not Found", http.StatusNotFound)
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	DEFAULT_FIND_FILES_LIMIT = 50
+	MAX_FIND_FILES_LIMIT     = 500
+)
+
+// Scoring for fuzzy matches, loosely modeled after fzf. Every matched character is worth
+// fuzzyScoreMatch, more when it starts a path segment or a camelCase word or follows the previous match.
+// Gaps between matched characters cost a little so tight matches win.
+const (
+	fuzzyScoreMatch       = 16
+	fuzzyBonusSegment     = 12
+	fuzzyBonusBoundary    = 10
+	fuzzyBonusCamelCase   = 8
+	fuzzyBonusConsecutive = 6
+	fuzzyBonusBasename    = 20
+	fuzzyPenaltyGapStart  = 3
+	fuzzyPenaltyGap       = 1
+)
+
+// pathIndex is an in-memory list of every non-ignored file in the workspace, kept current by the shared
+// workspace watcher so quick-open never has to walk the disk.
+type pathIndex struct {
+	root string
+
+	mu        sync.RWMutex
+	paths     []string
+	positions map[string]int
+}
+
+var (
+	pathIndexLock sync.Mutex
+	sharedPaths   *pathIndex
+)
+
+// getPathIndex builds the path index the first time it's needed and returns it afterwards. A failed build
+// isn't remembered so the next call gets to try again.
+func getPathIndex() (*pathIndex, error) {
+	pathIndexLock.Lock()
+	defer pathIndexLock.Unlock()
+
+	if sharedPaths == nil {
+		index, err := newPathIndex()
+		if err != nil {
+			return nil, err
+		}
+		sharedPaths = index
+	}
+	return sharedPaths, nil
+}
+
+func newPathIndex() (*pathIndex, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := getWorkspaceWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	index := &pathIndex{
+		root:      root,
+		paths:     make([]string, 0),
+		positions: make(map[string]int),
+	}
+
+	// Subscribe before walking so nothing created during the walk is missed.
+	events, unsubscribe := watcher.Subscribe()
+	if err := index.addDir(root); err != nil {
+		unsubscribe()
+		return nil, err
+	}
+
+	go func() {
+		for batch := range events {
+			for _, event := range batch {
+				index.handleEvent(event)
+			}
+		}
+	}()
+
+	log.Printf("Path index ready with %d files", len(index.paths))
+	return index, nil
+}
+
+func (index *pathIndex) addDir(dir string) error {
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != index.root && ignore.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			index.add(path)
+		}
+		return nil
+	})
+}
+
+func (index *pathIndex) add(path string) {
+	rel, err := filepath.Rel(index.root, path)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if _, exists := index.positions[rel]; !exists {
+		index.positions[rel] = len(index.paths)
+		index.paths = append(index.paths, rel)
+	}
+}
+
+// remove drops path, and everything underneath it in case it was a directory. Removing a file is O(1),
+// only a directory needs a pass over every path.
+func (index *pathIndex) remove(path string) {
+	rel, err := filepath.Rel(index.root, path)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	prefix := rel + "/"
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if _, exists := index.positions[rel]; exists {
+		index.removeLocked(rel)
+		return
+	}
+
+	for i := len(index.paths) - 1; i >= 0; i-- {
+		if strings.HasPrefix(index.paths[i], prefix) {
+			index.removeLocked(index.paths[i])
+		}
+	}
+}
+
+// removeLocked swaps rel with the last path and shrinks the slice, the order of paths doesn't matter
+// since search results are sorted anyway.
+func (index *pathIndex) removeLocked(rel string) {
+	i := index.positions[rel]
+	last := len(index.paths) - 1
+
+	index.paths[i] = index.paths[last]
+	index.positions[index.paths[i]] = i
+	index.paths = index.paths[:last]
+	delete(index.positions, rel)
+}
+
+func (index *pathIndex) handleEvent(event FileEvent) {
+	switch event.Op {
+	case FileCreated, FileWritten:
+		if event.IsDir {
+			index.addDir(event.Path)
+		} else {
+			index.add(event.Path)
+		}
+	case FileRemoved, FileRenamed:
+		index.remove(event.Path)
+	case FileResync:
+		index.rebuild()
+	}
+}
+
+// rebuild walks the workspace again and swaps in the result, for when watcher events were dropped.
+func (index *pathIndex) rebuild() {
+	fresh := &pathIndex{root: index.root, paths: make([]string, 0), positions: make(map[string]int)}
+	if err := fresh.addDir(index.root); err != nil {
+		log.Println("Failed to rebuild the path index", err.Error())
+		return
+	}
+
+	index.mu.Lock()
+	index.paths = fresh.paths
+	index.positions = fresh.positions
+	index.mu.Unlock()
+}
+
+type FindFileResult struct {
+	Path  string `json:"path"`
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+	// Positions are the rune offsets in Path that matched the query, for highlighting
+	Positions []int `json:"positions"`
+}
+
+// fuzzyBonus is what matching the character at i is worth on top of fuzzyScoreMatch.
+func fuzzyBonus(target []rune, i int) int {
+	if i == 0 {
+		return fuzzyBonusSegment
+	}
+	prev, cur := target[i-1], target[i]
+	switch {
+	case prev == '/':
+		return fuzzyBonusSegment
+	case prev == '_' || prev == '-' || prev == '.' || prev == ' ':
+		return fuzzyBonusBoundary
+	case unicode.IsLower(prev) && unicode.IsUpper(cur):
+		return fuzzyBonusCamelCase
+	case unicode.IsLetter(prev) && unicode.IsDigit(cur):
+		return fuzzyBonusCamelCase
+	}
+	return 0
+}
+
+// fuzzyMatch reports whether every rune of query appears in target in order, ignoring case. The match
+// that's scored is the shortest window ending at the earliest possible place, which is what fzf's fast
+// path does and is good enough for file names.
+func fuzzyMatch(target []rune, query []rune) (int, []int, bool) {
+	if len(query) == 0 {
+		return 0, []int{}, true
+	}
+
+	end := -1
+	for ti, qi := 0, 0; ti < len(target); ti++ {
+		if unicode.ToLower(target[ti]) == query[qi] {
+			qi++
+			if qi == len(query) {
+				end = ti
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	start := 0
+	for ti, qi := end, len(query)-1; ti >= 0; ti-- {
+		if unicode.ToLower(target[ti]) == query[qi] {
+			qi--
+			if qi < 0 {
+				start = ti
+				break
+			}
+		}
+	}
+
+	score := 0
+	positions := make([]int, 0, len(query))
+	consecutive := false
+	inGap := false
+	for ti, qi := start, 0; ti <= end && qi < len(query); ti++ {
+		if unicode.ToLower(target[ti]) != query[qi] {
+			if inGap {
+				score -= fuzzyPenaltyGap
+			} else {
+				score -= fuzzyPenaltyGapStart
+			}
+			inGap = true
+			consecutive = false
+			continue
+		}
+
+		score += fuzzyScoreMatch + fuzzyBonus(target, ti)
+		if consecutive {
+			score += fuzzyBonusConsecutive
+		}
+		positions = append(positions, ti)
+		consecutive = true
+		inGap = false
+		qi++
+	}
+
+	return score, positions, true
+}
+
+// hasSubsequence is fuzzyMatch without the scoring or allocations. Most paths don't match at all, so
+// checking first keeps searching tens of thousands of paths within a few milliseconds.
+func hasSubsequence(path string, query []rune) bool {
+	qi := 0
+	for _, r := range path {
+		if qi == len(query) {
+			break
+		}
+		if unicode.ToLower(r) == query[qi] {
+			qi++
+		}
+	}
+	return qi == len(query)
+}
+
+// scorePath ranks a workspace path against the query. Matches that fit entirely in the file name beat
+// matches spread across directories, so "app" finds App.tsx before app/utils/index.ts.
+func scorePath(path string, query []rune) (*FindFileResult, bool) {
+	if !hasSubsequence(path, query) {
+		return nil, false
+	}
+
+	target := []rune(path)
+	score, positions, _ := fuzzyMatch(target, query)
+
+	nameStart := len(target)
+	for nameStart > 0 && target[nameStart-1] != '/' {
+		nameStart--
+	}
+	name := target[nameStart:]
+	if nameScore, namePositions, ok := fuzzyMatch(name, query); ok && len(query) > 0 {
+		offset := len(target) - len(name)
+		for i := range namePositions {
+			namePositions[i] += offset
+		}
+		score, positions = nameScore+fuzzyBonusBasename, namePositions
+	}
+
+	return &FindFileResult{
+		Path:      path,
+		Name:      string(name),
+		Score:     score,
+		Positions: positions,
+	}, true
+}
+
+// Search returns the best limit matches for query.
+func (index *pathIndex) Search(query string, limit int) []*FindFileResult {
+	// Spaces are only there to make the query readable ("user contr" for UserController.ts)
+	runes := make([]rune, 0, len(query))
+	for _, r := range strings.ToLower(query) {
+		if !unicode.IsSpace(r) {
+			runes = append(runes, r)
+		}
+	}
+
+	index.mu.RLock()
+	results := make([]*FindFileResult, 0)
+	for _, path := range index.paths {
+		if result, ok := scorePath(path, runes); ok {
+			results = append(results, result)
+		}
+	}
+	index.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if len(results[i].Path) != len(results[j].Path) {
+			return len(results[i].Path) < len(results[j].Path)
+		}
+		return results[i].Path < results[j].Path
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// findFilesHandler is the "go to file" search. It answers from the in-memory path index, so it's fast
+// enough to call on every keystroke.
+func findFilesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+
+	limit := DEFAULT_FIND_FILES_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > MAX_FIND_FILES_LIMIT {
+			http.Error(w, "Param limit must be between 1 and "+strconv.Itoa(MAX_FIND_FILES_LIMIT), http.StatusBadRequest)
+			return
+		}
+	}
+
+	index, err := getPathIndex()
+	if err != nil {
+		log.Println("Failed to build path index", err.Error())
+		http.Error(w, "Failed to build path index", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, index.Search(query, limit))
+}
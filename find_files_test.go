@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PathIndexSearch(t *testing.T) {
+	index := &pathIndex{root: "/code", paths: make([]string, 0), positions: make(map[string]int)}
+	for _, path := range []string{
+		"frontend/src/App.tsx",
+		"frontend/src/app/utils/index.ts",
+		"backend/controllers/UserController.js",
+		"backend/models/user.js",
+		"frontend/src/components/UserCard.tsx",
+	} {
+		index.add("/code/" + path)
+	}
+
+	results := index.Search("app", 10)
+	assert.Equal(t, "frontend/src/App.tsx", results[0].Path)
+	assert.Equal(t, []int{13, 14, 15}, results[0].Positions)
+
+	results = index.Search("ucontr", 10)
+	assert.Equal(t, "backend/controllers/UserController.js", results[0].Path)
+
+	results = index.Search("models user", 10)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "backend/models/user.js", results[0].Path)
+
+	index.remove("/code/frontend/src")
+	assert.Equal(t, 0, len(index.Search("tsx", 10)))
+	assert.Equal(t, 2, len(index.Search("", 10)))
+
+	index.remove("/code/backend/controllers/UserController.js")
+	assert.Equal(t, []string{"backend/models/user.js"}, index.paths)
+	assert.Equal(t, map[string]int{"backend/models/user.js": 0}, index.positions)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os/exec"
 	"strings"
@@ -14,7 +17,6 @@ import (
 
 const (
 	repoName   = "swizzle-webserver-template"
-	repoDir    = "~/code"
 	defaultMsg = "swizzle automatic commit"
 )
 
@@ -25,6 +27,15 @@ type RequestBody struct {
 	Tag           string `json:"tag,omitempty"`
 }
 
+// openRepo opens the git repository of the workspace.
+func openRepo() (*git.Repository, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+	return git.PlainOpen(root)
+}
+
 func commitHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
@@ -38,20 +49,27 @@ func commitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repo, err := git.PlainOpen(repoDir)
+	repo, err := openRepo()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure on master branch
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	// Commits go to any branch except the protected ones, which only change through deployments
 	headRef, err := repo.Head()
 	if err != nil {
 		http.Error(w, "Could not fetch HEAD", http.StatusInternalServerError)
 		return
 	}
-	if headRef.Name().Short() != "master" {
-		http.Error(w, "Not on master branch", http.StatusForbidden)
+	if !headRef.Name().IsBranch() {
+		http.Error(w, "HEAD is detached, switch to a branch before committing", http.StatusConflict)
+		return
+	}
+	if isProtectedBranch(headRef.Name().Short()) {
+		http.Error(w, fmt.Sprintf("%s is a protected branch", headRef.Name().Short()), http.StatusForbidden)
 		return
 	}
 
@@ -123,7 +141,7 @@ func commitPushHandler(w http.ResponseWriter, r *http.Request) {
 		commitMsg = fmt.Sprintf("%s: %s", defaultMsg, time.Now())
 	}
 
-	repo, err := git.PlainOpen(repoDir)
+	repo, err := openRepo()
 	CheckIfError(w, err)
 
 	workTree, err := repo.Worktree()
@@ -168,6 +186,8 @@ type CommandRunner struct {
 	dir      string
 	output   string
 	exitCode int
+	// stream, when set, also gets the output while the command runs
+	stream io.Writer
 }
 
 func (runner *CommandRunner) Run(name string, args ...string) {
@@ -178,9 +198,15 @@ func (runner *CommandRunner) Run(name string, args ...string) {
 	cmd := exec.Command(name, args...)
 	cmd.Dir = runner.dir
 
-	output, err := cmd.CombinedOutput()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if runner.stream != nil {
+		cmd.Stdout = io.MultiWriter(&output, runner.stream)
+	}
+	cmd.Stderr = cmd.Stdout
+	err := cmd.Run()
 
-	runner.output = string(output)
+	runner.output = output.String()
 	runner.exitCode = cmd.ProcessState.ExitCode()
 
 	if err != nil {
@@ -196,61 +222,260 @@ const (
 	BuildTriggered PushProductionStatus = "BUILD_TRIGGERED"
 	NoChanges      PushProductionStatus = "NO_CHANGES"
 	Failed         PushProductionStatus = "FAILED"
+	ChecksFailed   PushProductionStatus = "CHECKS_FAILED"
 )
 
 type PushProductionResponse struct {
-	Status  PushProductionStatus `json:"status"`
-	Message string               `json:"message,omitempty"`
-	Commit  string               `json:"commit,omitempty"`
+	Status  PushProductionStatus    `json:"status"`
+	Message string                  `json:"message,omitempty"`
+	Commit  string                  `json:"commit,omitempty"`
+	Tag     string                  `json:"tag,omitempty"`
+	Checks  []*PredeployCheckResult `json:"checks,omitempty"`
 }
 
+type PushProductionRequest struct {
+	// TriggeredBy names who asked for the deployment, it's only recorded in the deployment ledger
+	TriggeredBy string `json:"triggeredBy"`
+	// SkipChecks pushes even when the pre-deploy checks would fail
+	SkipChecks bool `json:"skipChecks"`
+}
+
+// pushProduction starts a job that commits, checks and pushes master to release. It answers right away
+// with the job's ID, progress is at /jobs/{id}. Only one deploy runs at a time.
 func pushProduction(w http.ResponseWriter, r *http.Request) {
-	commitMessage := fmt.Sprintf("swizzle commit production: %s", time.Now().Format(time.RFC3339))
+	// The body is optional, older clients post without one
+	var req PushProductionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
 
-	runner := &CommandRunner{dir: "code"}
-	runner.Run("git", "add", ".")
-	runner.Run("git", "commit", "-m", commitMessage)
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
 
-	// Reset the runner because we always want to try a push even if the previous commands errored out.
-	// This is because 'git commit -m "..."' will return exit code 1 if there is nothing to commit.
-	// However, just because master is up-to-date doesn't mean that our release branch is so we should
-	// try doing a push anyways.
-	runner = &CommandRunner{dir: "code"}
-	runner.Run("git", "push", "-o", "nokeycheck", "origin", "master:master", "master:release")
+	// Whatever gets committed lands on HEAD while master is what gets pushed, so they have to be the same
+	if branch := headBranch(root); branch != "master" {
+		http.Error(w, fmt.Sprintf("HEAD is %s, switch to master before pushing to production", describeHead(branch)), http.StatusConflict)
+		return
+	}
 
-	if runner.err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		WriteJSONResponseWithHeader(w, http.StatusInternalServerError, &PushProductionResponse{
-			Status:  Failed,
-			Message: runner.err.Error(),
+	job, running := startDeployJob(JobPushProduction)
+	if running != nil {
+		WriteJSONResponseWithHeader(w, http.StatusConflict, &JobInProgressResponse{
+			Message: "A deploy is already in progress",
+			ID:      running.ID,
 		})
 		return
 	}
 
-	// There were no changes so we should notify the caller that no build will be triggered
-	not_build_triggered := strings.Contains(runner.output, "Everything up-to-date")
+	runJob(job, func() *PushProductionResponse {
+		return runPushProduction(root, &req, job)
+	})
 
-	// This shouldn't fail, but just in case we'll check for an error
-	runner.Run("git", "rev-parse", "HEAD")
+	WriteJSONResponseWithHeader(w, http.StatusAccepted, &JobStartedResponse{ID: job.ID, Kind: job.Kind})
+}
+
+// headBranch returns the branch HEAD is on, or "" when it's detached.
+func headBranch(root string) string {
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "symbolic-ref", "--quiet", "--short", "HEAD")
+	if runner.err != nil {
+		return ""
+	}
+	return strings.TrimSpace(runner.output)
+}
+
+func describeHead(branch string) string {
+	if branch == "" {
+		return "detached"
+	}
+	return "on " + branch
+}
+
+// runPushProduction only holds gitLock while it commits and while it pushes. The checks in between can
+// take minutes and work on a worktree of their own, so other git operations aren't held up by them.
+func runPushProduction(root string, req *PushProductionRequest, job *Job) *PushProductionResponse {
+	job.SetPhase("fetching")
+	deployment := &Deployment{
+		Kind:          DeploymentPush,
+		StartedAt:     time.Now(),
+		TriggeredBy:   req.TriggeredBy,
+		ChecksSkipped: req.SkipChecks,
+	}
+	previous, err := releaseHead(root)
+	releaseKnown := err == nil
+	if err != nil {
+		log.Println("Failed to fetch release, the deployment's diffstat will be unknown", err.Error())
+	}
+	deployment.Previous = previous
+	// The secrets check looks at what origin/master doesn't have yet, a stale one only means it scans more
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "fetch", "origin", "master")
 	if runner.err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		WriteJSONResponseWithHeader(w, http.StatusInternalServerError, &PushProductionResponse{
+		log.Println("Failed to fetch master", runner.err.Error())
+	}
+
+	finish := func(response *PushProductionResponse) *PushProductionResponse {
+		deployment.FinishedAt = time.Now()
+		deployment.Status = response.Status
+		deployment.Message = response.Message
+		deployment.Commit = response.Commit
+		deployment.Tag = response.Tag
+		deployment.Checks = response.Checks
+		recordDeployment(deployment)
+		return response
+	}
+
+	commitMessage := fmt.Sprintf("swizzle commit production: %s", deployment.StartedAt.Format(time.RFC3339))
+
+	commit, checks, failure := commitProduction(root, req, job, commitMessage)
+	if failure != nil {
+		return finish(failure)
+	}
+
+	// Nothing leaves the machine until the checks pass, the commit above is only local
+	if !req.SkipChecks {
+		job.SetPhase("checking")
+		results, passed := runPredeployChecks(root, commit, job)
+		checks = append(checks, results...)
+		if !passed {
+			return finish(&PushProductionResponse{
+				Status:  ChecksFailed,
+				Message: "Pre-deploy checks failed, fix them or push with skipChecks",
+				Commit:  commit,
+				Checks:  checks,
+			})
+		}
+	}
+	response := &PushProductionResponse{
+		Status: BuildTriggered,
+		Commit: commit,
+		Checks: checks,
+	}
+	// There are no changes when release already is master, so no build will be triggered
+	if releaseKnown && previous == response.Commit {
+		response.Status = NoChanges
+	}
+
+	job.SetPhase("pushing")
+	tag, err := pushProductionCommit(root, commit, response.Status == BuildTriggered, commitMessage, deployment.StartedAt, job)
+	if err != nil {
+		return finish(&PushProductionResponse{
 			Status:  Failed,
-			Message: runner.err.Error(),
+			Message: err.Error(),
+			Commit:  commit,
+			Checks:  checks,
 		})
-		return
+	}
+	response.Tag = tag
+
+	// Without knowing where release was the diffstat would be made up, it's left out instead
+	if releaseKnown {
+		if stat, err := deploymentDiffStat(root, previous, response.Commit); err == nil {
+			deployment.DiffStat = stat
+		} else {
+			log.Println("Failed to compute deployment diffstat", err.Error())
+		}
+	}
+
+	job.SetPhase("done")
+	return finish(response)
+}
+
+// commitProduction commits whatever changed in the workspace to master and returns the commit to release.
+// Secrets are looked for before committing so they never make it into a commit, not even a local one.
+// On failure the response to finish the deployment with is returned instead.
+func commitProduction(root string, req *PushProductionRequest, job *Job, message string) (string, []*PredeployCheckResult, *PushProductionResponse) {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	// pushProduction checked already, but a checkout may have happened since
+	if branch := headBranch(root); branch != "master" {
+		return "", nil, &PushProductionResponse{
+			Status:  Failed,
+			Message: fmt.Sprintf("HEAD is %s, switch to master before pushing to production", describeHead(branch)),
+		}
 	}
 
-	commit := strings.TrimSpace(runner.output)
-	status := BuildTriggered
-	if not_build_triggered {
-		status = NoChanges
+	checks := make([]*PredeployCheckResult, 0)
+	if !req.SkipChecks && predeployCheckEnabled(PredeploySecrets) {
+		job.SetPhase("scanning")
+		started := time.Now()
+		secrets := secretsCheck(root)
+		secrets.Name = PredeploySecrets
+		secrets.Took = time.Since(started).Milliseconds()
+		checks = append(checks, secrets)
+		if !secrets.Passed {
+			return "", checks, &PushProductionResponse{
+				Status:  ChecksFailed,
+				Message: "Pre-deploy checks failed, fix them or push with skipChecks",
+				Checks:  checks,
+			}
+		}
 	}
 
-	WriteJSONResponse(w, &PushProductionResponse{
-		Status: status,
-		Commit: commit,
-	})
+	failed := func(err error) (string, []*PredeployCheckResult, *PushProductionResponse) {
+		return "", checks, &PushProductionResponse{Status: Failed, Message: err.Error(), Checks: checks}
+	}
+
+	job.SetPhase("committing")
+	runner := &CommandRunner{dir: root, stream: job}
+	runner.Run("git", "add", ".")
+	if runner.err != nil {
+		return failed(runner.err)
+	}
+
+	// With nothing to commit master is released as it is, release may still be behind it. diff --quiet
+	// exits with 1 when there are staged changes.
+	staged := &CommandRunner{dir: root}
+	staged.Run("git", "diff", "--cached", "--quiet")
+	if staged.exitCode == 1 {
+		runner.Run("git", "commit", "-m", message)
+	} else if staged.err != nil {
+		return failed(staged.err)
+	}
+	if runner.err != nil {
+		return failed(runner.err)
+	}
+
+	runner = &CommandRunner{dir: root}
+	runner.Run("git", "rev-parse", "refs/heads/master")
+	if runner.err != nil {
+		return failed(runner.err)
+	}
+	return strings.TrimSpace(runner.output), checks, nil
+}
+
+// pushProductionCommit pushes commit to master and release on origin, tagged when tagIt is set. It's the
+// commit that's pushed rather than master, that's what was checked even if master moved on meanwhile.
+func pushProductionCommit(root string, commit string, tagIt bool, message string, at time.Time, job *Job) (string, error) {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	refspecs := []string{commit + ":refs/heads/master", commit + ":refs/heads/release"}
+	tag := ""
+	if tagIt {
+		var err error
+		tag, err = tagDeployment(&CommandRunner{dir: root}, DeploymentPush, commit, message, at)
+		if err != nil {
+			return "", err
+		}
+		refspecs = append(refspecs, "refs/tags/"+tag)
+	}
+
+	// Atomic so the tag only exists when release actually moved
+	runner := &CommandRunner{dir: root, stream: job}
+	runner.Run("git", append([]string{"push", "--atomic", "--progress", "-o", "nokeycheck", "origin"}, refspecs...)...)
+	if runner.err != nil {
+		if tag != "" {
+			untagDeployment(root, tag)
+		}
+		return "", runner.err
+	}
+	return tag, nil
 }
 
 func mergeMasterIntoRelease() error {
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Commits and pushes never go directly to these branches, deployments update them from master.
+// FERMAT_PROTECTED_BRANCHES overrides the comma separated list.
+const DEFAULT_PROTECTED_BRANCHES = "release,production"
+
+// gitLock serializes everything that changes the repository (commits, checkouts, branch operations) so
+// two requests can't interleave git commands.
+var gitLock sync.Mutex
+
+type BranchInfo struct {
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	Current   bool   `json:"current"`
+	Protected bool   `json:"protected"`
+	// Remote is set for branches that only exist on origin
+	Remote   bool   `json:"remote"`
+	Upstream string `json:"upstream,omitempty"`
+	Ahead    int    `json:"ahead"`
+	Behind   int    `json:"behind"`
+}
+
+type CreateBranchRequest struct {
+	Name string `json:"name"`
+	// From is the branch, tag or commit to start from, HEAD when empty
+	From     string `json:"from"`
+	Checkout bool   `json:"checkout"`
+}
+
+type CheckoutBranchRequest struct {
+	Branch string `json:"branch"`
+	// Stash puts uncommitted changes (including untracked files) on the stash before switching
+	Stash bool `json:"stash"`
+	// Force throws uncommitted changes away
+	Force bool `json:"force"`
+}
+
+type CheckoutBranchResponse struct {
+	Branch  string `json:"branch"`
+	Head    string `json:"head"`
+	Stashed bool   `json:"stashed"`
+	Stash   string `json:"stash,omitempty"`
+}
+
+type DirtyWorktreeResponse struct {
+	Message string           `json:"message"`
+	Files   []*GitFileStatus `json:"files"`
+}
+
+type RenameBranchRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func protectedBranches() map[string]bool {
+	names, ok := os.LookupEnv("FERMAT_PROTECTED_BRANCHES")
+	if !ok {
+		names = DEFAULT_PROTECTED_BRANCHES
+	}
+
+	protected := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			protected[name] = true
+		}
+	}
+	return protected
+}
+
+func isProtectedBranch(name string) bool {
+	return protectedBranches()[name]
+}
+
+// gitRunner returns a CommandRunner for git commands in the workspace repository.
+func gitRunner() (*CommandRunner, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+	return &CommandRunner{dir: root}, nil
+}
+
+// validBranchName asks git itself whether name can be used for a branch.
+func validBranchName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "-") {
+		return false
+	}
+	runner, err := gitRunner()
+	if err != nil {
+		return false
+	}
+	runner.Run("git", "check-ref-format", "--branch", name)
+	return runner.err == nil
+}
+
+// dirtyFiles returns the tracked files with uncommitted changes. Untracked files don't count, git
+// refuses by itself to switch branches when one of them would be overwritten.
+func dirtyFiles() ([]*GitFileStatus, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	files, err := workingTreeChanges(repo, root)
+	if err != nil {
+		return nil, err
+	}
+
+	dirty := make([]*GitFileStatus, 0)
+	for _, file := range files {
+		if !file.Untracked {
+			dirty = append(dirty, file)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].Path < dirty[j].Path })
+	return dirty, nil
+}
+
+func listBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	current := ""
+	if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+		current = head.Name().Short()
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list branches: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	protected := protectedBranches()
+	local := make(map[string]*BranchInfo)
+	remote := make(map[string]*plumbing.Reference)
+
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		switch {
+		case name.IsBranch():
+			local[name.Short()] = &BranchInfo{
+				Name:      name.Short(),
+				Hash:      ref.Hash().String(),
+				Current:   name.Short() == current,
+				Protected: protected[name.Short()],
+			}
+		case name.IsRemote() && strings.HasPrefix(name.String(), "refs/remotes/origin/") && ref.Type() == plumbing.HashReference:
+			remote[strings.TrimPrefix(name.String(), "refs/remotes/origin/")] = ref
+		}
+		return nil
+	})
+
+	branches := make([]*BranchInfo, 0, len(local)+len(remote))
+	for name, branch := range local {
+		if upstream, ok := remote[name]; ok {
+			branch.Upstream = "origin/" + name
+			branch.Ahead, branch.Behind, _ = aheadBehind(repo, plumbing.NewHash(branch.Hash), upstream.Hash())
+		}
+		branches = append(branches, branch)
+	}
+	for name, ref := range remote {
+		if _, ok := local[name]; !ok && name != "HEAD" {
+			branches = append(branches, &BranchInfo{
+				Name:      name,
+				Hash:      ref.Hash().String(),
+				Protected: protected[name],
+				Remote:    true,
+				Upstream:  "origin/" + name,
+			})
+		}
+	}
+
+	sort.Slice(branches, func(i, j int) bool {
+		if branches[i].Remote != branches[j].Remote {
+			return !branches[i].Remote
+		}
+		return branches[i].Name < branches[j].Name
+	})
+
+	WriteJSONResponse(w, branches)
+}
+
+// checkoutBranch switches to branch, which may only exist on origin, and writes the response. It reports
+// whether the switch happened. The caller holds gitLock.
+func checkoutBranch(w http.ResponseWriter, req *CheckoutBranchRequest) bool {
+	response := &CheckoutBranchResponse{Branch: req.Branch}
+
+	if !req.Force {
+		dirty, err := dirtyFiles()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read git status: %s", err), http.StatusInternalServerError)
+			return false
+		}
+
+		if len(dirty) > 0 && !req.Stash {
+			WriteJSONResponseWithHeader(w, http.StatusConflict, &DirtyWorktreeResponse{
+				Message: "There are uncommitted changes, commit them or switch with stash or force",
+				Files:   dirty,
+			})
+			return false
+		}
+
+		if len(dirty) > 0 {
+			runner, err := gitRunner()
+			if err != nil {
+				http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+				return false
+			}
+			message := "fermat: changes left on switching to " + req.Branch
+			runner.Run("git", "stash", "push", "--include-untracked", "-m", message)
+			if runner.err != nil {
+				http.Error(w, runner.err.Error(), http.StatusInternalServerError)
+				return false
+			}
+			response.Stashed = true
+			response.Stash = message
+		}
+	}
+
+	runner, err := gitRunner()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return false
+	}
+	if req.Force {
+		runner.Run("git", "switch", "--discard-changes", req.Branch)
+	} else {
+		runner.Run("git", "switch", req.Branch)
+	}
+	if runner.err != nil {
+		http.Error(w, runner.err.Error(), http.StatusConflict)
+		return false
+	}
+
+	runner.Run("git", "rev-parse", "HEAD")
+	response.Head = strings.TrimSpace(runner.output)
+
+	WriteJSONResponse(w, response)
+	return true
+}
+
+func createBranchHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateBranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !validBranchName(req.Name) {
+		http.Error(w, "Invalid branch name", http.StatusBadRequest)
+		return
+	}
+	if isProtectedBranch(req.Name) {
+		http.Error(w, fmt.Sprintf("%s is a protected branch", req.Name), http.StatusForbidden)
+		return
+	}
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := repo.Reference(plumbing.NewBranchReferenceName(req.Name), false); err == nil {
+		http.Error(w, fmt.Sprintf("Branch %s already exists", req.Name), http.StatusConflict)
+		return
+	}
+
+	from := req.From
+	if from == "" {
+		from = "HEAD"
+	}
+	commit, err := resolveCommit(repo, from)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown revision %s", from), http.StatusNotFound)
+		return
+	}
+
+	// Refuse up front rather than leave the branch behind when the checkout can't happen
+	if req.Checkout {
+		dirty, err := dirtyFiles()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read git status: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if len(dirty) > 0 {
+			WriteJSONResponseWithHeader(w, http.StatusConflict, &DirtyWorktreeResponse{
+				Message: "There are uncommitted changes, commit them or create the branch without checkout",
+				Files:   dirty,
+			})
+			return
+		}
+	}
+
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(req.Name), commit.Hash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create branch: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Checkout {
+		// The switch can still fail, e.g. on untracked files that are in the way
+		if !checkoutBranch(w, &CheckoutBranchRequest{Branch: req.Name}) {
+			if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
+				log.Println("Failed to remove branch after failed checkout", req.Name, err.Error())
+			}
+		}
+		return
+	}
+
+	WriteJSONResponseWithHeader(w, http.StatusCreated, &BranchInfo{
+		Name: req.Name,
+		Hash: commit.Hash.String(),
+	})
+}
+
+// checkoutBranchHandler switches branches. It refuses when there are uncommitted changes unless they
+// should be stashed or thrown away.
+func checkoutBranchHandler(w http.ResponseWriter, r *http.Request) {
+	var req CheckoutBranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !validBranchName(req.Branch) {
+		http.Error(w, "Invalid branch name", http.StatusBadRequest)
+		return
+	}
+	if req.Stash && req.Force {
+		http.Error(w, "Only one of stash and force can be set", http.StatusBadRequest)
+		return
+	}
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	checkoutBranch(w, &req)
+}
+
+func renameBranchHandler(w http.ResponseWriter, r *http.Request) {
+	var req RenameBranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !validBranchName(req.From) || !validBranchName(req.To) {
+		http.Error(w, "Invalid branch name", http.StatusBadRequest)
+		return
+	}
+	if isProtectedBranch(req.From) || isProtectedBranch(req.To) {
+		http.Error(w, "Protected branches can't be renamed", http.StatusForbidden)
+		return
+	}
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	runner, err := gitRunner()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+	runner.Run("git", "branch", "-m", req.From, req.To)
+	if runner.err != nil {
+		http.Error(w, runner.err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Branch renamed"))
+}
+
+// deleteBranchHandler deletes a local branch, the name can contain slashes. Branches with commits that
+// aren't merged anywhere are only deleted with force=true.
+func deleteBranchHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+	if !validBranchName(name) {
+		http.Error(w, "Invalid branch name", http.StatusBadRequest)
+		return
+	}
+	if isProtectedBranch(name) {
+		http.Error(w, fmt.Sprintf("%s is a protected branch", name), http.StatusForbidden)
+		return
+	}
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if head, err := repo.Head(); err == nil && head.Name() == plumbing.NewBranchReferenceName(name) {
+		http.Error(w, "Can't delete the current branch", http.StatusConflict)
+		return
+	}
+
+	runner, err := gitRunner()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("force") == "true" {
+		runner.Run("git", "branch", "-D", name)
+	} else {
+		runner.Run("git", "branch", "-d", name)
+	}
+	if runner.err != nil {
+		http.Error(w, runner.err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Branch deleted"))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+)
+
+// initTestRepo points HOME at a temp dir and creates a repository with one commit on master in the
+// workspace, returning the workspace root.
+func initTestRepo(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "Test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	root := filepath.Join(home, "code")
+	assert.Nil(t, os.MkdirAll(root, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "server.js"), []byte("console.log('one')\n"), 0644))
+	runTestGit(t, root, "init", "--initial-branch", "master")
+	runTestGit(t, root, "add", "--all")
+	runTestGit(t, root, "commit", "-m", "initial")
+
+	root, err := filepath.EvalSymlinks(root)
+	assert.Nil(t, err)
+	return root
+}
+
+func runTestGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func Test_ProtectedBranches(t *testing.T) {
+	// t.Setenv restores the variable afterwards, it has to be unset to get the defaults
+	t.Setenv("FERMAT_PROTECTED_BRANCHES", "")
+	os.Unsetenv("FERMAT_PROTECTED_BRANCHES")
+	assert.True(t, isProtectedBranch("release"))
+	assert.True(t, isProtectedBranch("production"))
+	assert.False(t, isProtectedBranch("master"))
+
+	t.Setenv("FERMAT_PROTECTED_BRANCHES", " master, main ,")
+	assert.True(t, isProtectedBranch("master"))
+	assert.True(t, isProtectedBranch("main"))
+	assert.False(t, isProtectedBranch("release"))
+	assert.False(t, isProtectedBranch(""))
+
+	t.Setenv("FERMAT_PROTECTED_BRANCHES", "")
+	assert.False(t, isProtectedBranch("release"))
+}
+
+func Test_CreateBranchCheckoutDirty(t *testing.T) {
+	root := initTestRepo(t)
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "server.js"), []byte("console.log('two')\n"), 0644))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/git/branches", strings.NewReader(`{"name": "feature", "checkout": true}`))
+	createBranchHandler(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	repo, err := openRepo()
+	assert.Nil(t, err)
+	_, err = repo.Reference(plumbing.NewBranchReferenceName("feature"), false)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+
+	// An untracked file in the way only shows up when switching, the branch is removed again
+	runTestGit(t, root, "checkout", "--", "server.js")
+	runTestGit(t, root, "switch", "-c", "other")
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "notes.md"), []byte("committed\n"), 0644))
+	runTestGit(t, root, "add", "notes.md")
+	runTestGit(t, root, "commit", "-m", "notes")
+	runTestGit(t, root, "switch", "master")
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "notes.md"), []byte("untracked\n"), 0644))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/git/branches", strings.NewReader(`{"name": "feature", "from": "other", "checkout": true}`))
+	createBranchHandler(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	_, err = repo.Reference(plumbing.NewBranchReferenceName("feature"), false)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+	assert.Equal(t, "master", runTestGit(t, root, "branch", "--show-current"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/git/branches", strings.NewReader(`{"name": "feature", "checkout": true}`))
+	createBranchHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "feature", runTestGit(t, root, "branch", "--show-current"))
+}
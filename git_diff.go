@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Files bigger than FERMAT_DIFF_MAX_FILE_BYTES on either side are reported without hunks.
+const DEFAULT_DIFF_MAX_FILE_BYTES = 1 << 20
+
+const defaultDiffContext = 3
+
+// The pseudo revisions a diff can be taken against besides real commits.
+const (
+	diffWorktree = "WORKTREE"
+	diffIndex    = "INDEX"
+)
+
+type DiffLineType string
+
+const (
+	DiffContext DiffLineType = "context"
+	DiffAdd     DiffLineType = "add"
+	DiffDelete  DiffLineType = "delete"
+)
+
+// DiffLine is one line of a hunk. Content has no line ending. OldLine is 0 for added lines and NewLine is
+// 0 for deleted lines.
+type DiffLine struct {
+	Type    DiffLineType `json:"type"`
+	Content string       `json:"content"`
+	OldLine int          `json:"oldLine,omitempty"`
+	NewLine int          `json:"newLine,omitempty"`
+	// NoNewline marks the last line of a file that doesn't end with a line break
+	NoNewline bool `json:"noNewline,omitempty"`
+}
+
+type DiffHunk struct {
+	OldStart int        `json:"oldStart"`
+	OldLines int        `json:"oldLines"`
+	NewStart int        `json:"newStart"`
+	NewLines int        `json:"newLines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+func (hunk *DiffHunk) header() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", hunk.OldStart, hunk.OldLines, hunk.NewStart, hunk.NewLines)
+}
+
+// FileDiff is the difference for one file. Binary and TooLarge files have no hunks.
+type FileDiff struct {
+	Path      string     `json:"path"`
+	OldPath   string     `json:"oldPath,omitempty"`
+	Status    GitChange  `json:"status"`
+	Binary    bool       `json:"binary"`
+	TooLarge  bool       `json:"tooLarge"`
+	Additions int        `json:"additions"`
+	Deletions int        `json:"deletions"`
+	Hunks     []DiffHunk `json:"hunks"`
+}
+
+type GitDiffResponse struct {
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Files []*FileDiff `json:"files"`
+	// Patch is the unified diff of all files, only when asked for with raw=true
+	Patch string `json:"patch,omitempty"`
+}
+
+// diffSide is one version of a file. A side that doesn't exist is an add or a delete.
+type diffSide struct {
+	path     string
+	exists   bool
+	content  []byte
+	tooLarge bool
+}
+
+type diffPair struct {
+	old diffSide
+	new diffSide
+}
+
+func maxDiffFileBytes() int64 {
+	return envInt64("FERMAT_DIFF_MAX_FILE_BYTES", DEFAULT_DIFF_MAX_FILE_BYTES)
+}
+
+func readDiffSide(path string, size int64, open func() (io.ReadCloser, error)) (diffSide, error) {
+	side := diffSide{path: path, exists: true}
+	if size > maxDiffFileBytes() {
+		side.tooLarge = true
+		return side, nil
+	}
+
+	reader, err := open()
+	if err != nil {
+		return side, err
+	}
+	defer reader.Close()
+
+	side.content, err = io.ReadAll(reader)
+	return side, err
+}
+
+func treeSide(tree *object.Tree, path string) (diffSide, error) {
+	if tree == nil || path == "" {
+		return diffSide{path: path}, nil
+	}
+	file, err := tree.File(path)
+	if err == object.ErrFileNotFound {
+		return diffSide{path: path}, nil
+	}
+	if err != nil {
+		return diffSide{}, err
+	}
+	return readDiffSide(path, file.Size, file.Reader)
+}
+
+func indexSide(repo *git.Repository, path string) (diffSide, error) {
+	index, err := repo.Storer.Index()
+	if err != nil {
+		return diffSide{}, err
+	}
+	entry, err := index.Entry(path)
+	if err != nil {
+		return diffSide{path: path}, nil
+	}
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return diffSide{}, err
+	}
+	return readDiffSide(path, blob.Size, blob.Reader)
+}
+
+func worktreeSide(root string, path string) (diffSide, error) {
+	fullPath := filepath.Join(root, filepath.FromSlash(path))
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return diffSide{path: path}, nil
+	}
+	if err != nil {
+		return diffSide{}, err
+	}
+	return readDiffSide(path, info.Size(), func() (io.ReadCloser, error) { return os.Open(fullPath) })
+}
+
+// resolveCommit resolves a branch, tag or hash. Branches that only exist on origin (release usually
+// does, fermat pushes master:release without checking it out) are found too.
+func resolveCommit(repo *git.Repository, rev string) (*object.Commit, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		remoteHash, remoteErr := repo.ResolveRevision(plumbing.Revision("origin/" + rev))
+		if remoteErr != nil {
+			return nil, err
+		}
+		hash = remoteHash
+	}
+	return repo.CommitObject(*hash)
+}
+
+func headTree(repo *git.Repository) (*object.Tree, error) {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// uncommittedDiffPairs compares HEAD with either the working tree or, when staged is set, the index.
+func uncommittedDiffPairs(repo *git.Repository, staged bool) ([]diffPair, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := workingTreeChanges(repo, root)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]diffPair, 0, len(files))
+	for _, file := range files {
+		if staged && (file.Staged == GitUnmodified || file.Untracked) {
+			continue
+		}
+
+		oldPath := file.Path
+		if file.OldPath != "" && (!staged || file.Staged == GitRenamed) {
+			oldPath = file.OldPath
+		}
+
+		var pair diffPair
+		if pair.old, err = treeSide(tree, oldPath); err != nil {
+			return nil, err
+		}
+		if staged {
+			pair.new, err = indexSide(repo, file.Path)
+		} else {
+			pair.new, err = worktreeSide(root, file.Path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// commitDiffPairs compares two commits, with rename detection. A nil from compares with an empty tree.
+func commitDiffPairs(from *object.Commit, to *object.Commit) ([]diffPair, error) {
+	fromTree := &object.Tree{}
+	if from != nil {
+		tree, err := from.Tree()
+		if err != nil {
+			return nil, err
+		}
+		fromTree = tree
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTreeWithOptions(context.Background(), fromTree, toTree, object.DefaultDiffTreeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]diffPair, 0, len(changes))
+	for _, change := range changes {
+		var pair diffPair
+		if pair.old, err = treeSide(fromTree, change.From.Name); err != nil {
+			return nil, err
+		}
+		if pair.new, err = treeSide(toTree, change.To.Name); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// diffLines turns the two versions of a file into hunks with the given number of context lines.
+func diffLines(oldContent string, newContent string, contextLines int) ([]DiffHunk, int, int) {
+	lines := make([]DiffLine, 0)
+	oldLine, newLine := 0, 0
+	additions, deletions := 0, 0
+
+	for _, chunk := range diff.Do(oldContent, newContent) {
+		for _, text := range splitLinesKeepEnds(chunk.Text) {
+			line := DiffLine{Content: strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")}
+			line.NoNewline = !strings.HasSuffix(text, "\n")
+			switch chunk.Type {
+			case diffmatchpatch.DiffEqual:
+				oldLine++
+				newLine++
+				line.Type, line.OldLine, line.NewLine = DiffContext, oldLine, newLine
+			case diffmatchpatch.DiffDelete:
+				oldLine++
+				deletions++
+				line.Type, line.OldLine = DiffDelete, oldLine
+			case diffmatchpatch.DiffInsert:
+				newLine++
+				additions++
+				line.Type, line.NewLine = DiffAdd, newLine
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	hunks := make([]DiffHunk, 0)
+	for i := 0; i < len(lines); i++ {
+		if lines[i].Type == DiffContext {
+			continue
+		}
+
+		// Start the hunk context lines before the first change and keep extending it while the next
+		// change is close enough that the context would overlap.
+		start := i - contextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(lines) && j <= end+2*contextLines+1; j++ {
+			if lines[j].Type != DiffContext {
+				end = j
+			}
+		}
+		stop := end + contextLines + 1
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		hunk := DiffHunk{Lines: lines[start:stop]}
+		oldBefore, newBefore := 0, 0
+		for _, line := range lines[:start] {
+			if line.Type != DiffAdd {
+				oldBefore++
+			}
+			if line.Type != DiffDelete {
+				newBefore++
+			}
+		}
+		for _, line := range hunk.Lines {
+			if line.Type != DiffAdd {
+				hunk.OldLines++
+			}
+			if line.Type != DiffDelete {
+				hunk.NewLines++
+			}
+		}
+		// Like git, an empty side starts at the line before the change
+		hunk.OldStart, hunk.NewStart = oldBefore, newBefore
+		if hunk.OldLines > 0 {
+			hunk.OldStart++
+		}
+		if hunk.NewLines > 0 {
+			hunk.NewStart++
+		}
+
+		hunks = append(hunks, hunk)
+		i = stop - 1
+	}
+
+	return hunks, additions, deletions
+}
+
+func buildFileDiff(pair diffPair, contextLines int) *FileDiff {
+	file := &FileDiff{Path: pair.new.path, Status: GitModified, Hunks: make([]DiffHunk, 0)}
+	switch {
+	case !pair.old.exists:
+		file.Status = GitAdded
+	case !pair.new.exists:
+		file.Status = GitDeleted
+		file.Path = pair.old.path
+	case pair.old.path != pair.new.path:
+		file.Status = GitRenamed
+		file.OldPath = pair.old.path
+	}
+
+	if pair.old.tooLarge || pair.new.tooLarge {
+		file.TooLarge = true
+		return file
+	}
+	if isBinaryContent(pair.old.content) || isBinaryContent(pair.new.content) {
+		file.Binary = true
+		return file
+	}
+
+	file.Hunks, file.Additions, file.Deletions = diffLines(string(pair.old.content), string(pair.new.content), contextLines)
+	return file
+}
+
+// unifiedPatch renders the file diffs the way `git diff` does so the output can be fed to `git apply`.
+func unifiedPatch(files []*FileDiff) string {
+	var patch strings.Builder
+	for _, file := range files {
+		oldPath, newPath := "a/"+file.Path, "b/"+file.Path
+		if file.OldPath != "" {
+			oldPath = "a/" + file.OldPath
+		}
+		fmt.Fprintf(&patch, "diff --git %s %s\n", oldPath, newPath)
+
+		switch file.Status {
+		case GitAdded:
+			patch.WriteString("new file mode 100644\n")
+			oldPath = "/dev/null"
+		case GitDeleted:
+			patch.WriteString("deleted file mode 100644\n")
+			newPath = "/dev/null"
+		case GitRenamed:
+			fmt.Fprintf(&patch, "rename from %s\nrename to %s\n", file.OldPath, file.Path)
+		}
+
+		if file.Binary || file.TooLarge {
+			fmt.Fprintf(&patch, "Binary files %s and %s differ\n", oldPath, newPath)
+			continue
+		}
+		if len(file.Hunks) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&patch, "--- %s\n+++ %s\n", oldPath, newPath)
+		for _, hunk := range file.Hunks {
+			patch.WriteString(hunk.header() + "\n")
+			for _, line := range hunk.Lines {
+				prefix := " "
+				switch line.Type {
+				case DiffAdd:
+					prefix = "+"
+				case DiffDelete:
+					prefix = "-"
+				}
+				patch.WriteString(prefix + line.Content + "\n")
+				if line.NoNewline {
+					patch.WriteString("\\ No newline at end of file\n")
+				}
+			}
+		}
+	}
+	return patch.String()
+}
+
+// gitDiffHandler returns what changed between two versions of the workspace:
+//
+//	/git/diff                          working tree vs HEAD
+//	/git/diff?staged=true              index vs HEAD
+//	/git/diff?from=<rev>&to=<rev>      any two commits, branches or tags, e.g. from=release&to=master
+//
+// path limits the diff to a file or directory, context sets the number of context lines and raw=true
+// adds the unified patch.
+func gitDiffHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	contextLines := defaultDiffContext
+	if value := query.Get("context"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Param context must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		contextLines = parsed
+	}
+
+	staged := query.Get("staged") == "true"
+	from, to := query.Get("from"), query.Get("to")
+	if (from == "") != (to == "") {
+		http.Error(w, "Params from and to must be given together", http.StatusBadRequest)
+		return
+	}
+	if staged && from != "" {
+		http.Error(w, "Param staged can't be combined with from and to", http.StatusBadRequest)
+		return
+	}
+
+	scope := cleanRepoPath(query.Get("path"))
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := &GitDiffResponse{Files: make([]*FileDiff, 0)}
+
+	var pairs []diffPair
+	if from != "" {
+		fromCommit, err := resolveCommit(repo, from)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unknown revision %s", from), http.StatusNotFound)
+			return
+		}
+		toCommit, err := resolveCommit(repo, to)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unknown revision %s", to), http.StatusNotFound)
+			return
+		}
+		response.From, response.To = fromCommit.Hash.String(), toCommit.Hash.String()
+		pairs, err = commitDiffPairs(fromCommit, toCommit)
+	} else {
+		response.From, response.To = "HEAD", diffWorktree
+		if staged {
+			response.To = diffIndex
+		}
+		pairs, err = uncommittedDiffPairs(repo, staged)
+	}
+	if err != nil {
+		log.Println("Failed to diff", err.Error())
+		http.Error(w, "Failed to diff: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	inScope := func(path string) bool {
+		return scope == "" || path == scope || strings.HasPrefix(path, scope+"/")
+	}
+
+	for _, pair := range pairs {
+		if !inScope(pair.old.path) && !inScope(pair.new.path) {
+			continue
+		}
+		if pair.old.exists == pair.new.exists && pair.old.path == pair.new.path && !pair.old.tooLarge && !pair.new.tooLarge && string(pair.old.content) == string(pair.new.content) {
+			// e.g. a change that was staged and then undone in the working tree
+			continue
+		}
+		response.Files = append(response.Files, buildFileDiff(pair, contextLines))
+	}
+	sort.Slice(response.Files, func(i, j int) bool { return response.Files[i].Path < response.Files[j].Path })
+
+	if query.Get("raw") == "true" {
+		response.Patch = unifiedPatch(response.Files)
+	}
+
+	WriteJSONResponse(w, response)
+}
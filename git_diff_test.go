@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiffLines(t *testing.T) {
+	oldContent := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	newContent := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk"
+
+	hunks, additions, deletions := diffLines(oldContent, newContent, 1)
+	assert.Equal(t, 2, additions)
+	assert.Equal(t, 1, deletions)
+	assert.Equal(t, 2, len(hunks))
+	assert.Equal(t, "@@ -1,3 +1,3 @@", hunks[0].header())
+	assert.Equal(t, "@@ -10,1 +10,2 @@", hunks[1].header())
+	assert.True(t, hunks[1].Lines[1].NoNewline)
+
+	// With enough context both changes end up in the same hunk
+	hunks, _, _ = diffLines(oldContent, newContent, 4)
+	assert.Equal(t, 1, len(hunks))
+	assert.Equal(t, "@@ -1,10 +1,11 @@", hunks[0].header())
+
+	hunks, _, _ = diffLines("", "x\n", 3)
+	assert.Equal(t, "@@ -0,0 +1,1 @@", hunks[0].header())
+
+	patch := unifiedPatch([]*FileDiff{{Path: "a.txt", Status: GitAdded, Hunks: hunks}})
+	assert.Equal(t, "diff --git a/a.txt b/a.txt\nnew file mode 100644\n--- /dev/null\n+++ b/a.txt\n@@ -0,0 +1,1 @@\n+x\n", patch)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	DEFAULT_LOG_LIMIT = 50
+	MAX_LOG_LIMIT     = 500
+)
+
+var errLogPageFull = errors.New("log page full")
+
+type GitPerson struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+type GitCommit struct {
+	Hash      string    `json:"hash"`
+	ShortHash string    `json:"shortHash"`
+	Summary   string    `json:"summary"`
+	Message   string    `json:"message"`
+	Author    GitPerson `json:"author"`
+	Committer GitPerson `json:"committer"`
+	Parents   []string  `json:"parents"`
+	Tags      []string  `json:"tags"`
+}
+
+type GitLogResponse struct {
+	Commits []*GitCommit `json:"commits"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+	HasMore bool         `json:"hasMore"`
+}
+
+type GitShowResponse struct {
+	Commit *GitCommit  `json:"commit"`
+	Files  []*FileDiff `json:"files"`
+}
+
+type BlameLine struct {
+	Line        int       `json:"line"`
+	Text        string    `json:"text"`
+	Hash        string    `json:"hash"`
+	Author      string    `json:"author"`
+	AuthorEmail string    `json:"authorEmail"`
+	When        time.Time `json:"when"`
+}
+
+type GitBlameResponse struct {
+	Path  string       `json:"path"`
+	Rev   string       `json:"rev"`
+	Lines []*BlameLine `json:"lines"`
+}
+
+// commitTags maps commit hashes to the tags pointing at them, resolving annotated tags to their commit.
+func commitTags(repo *git.Repository) map[plumbing.Hash][]string {
+	tags := make(map[plumbing.Hash][]string)
+
+	refs, err := repo.Tags()
+	if err != nil {
+		return tags
+	}
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			if commit, err := tag.Commit(); err == nil {
+				hash = commit.Hash
+			}
+		}
+		tags[hash] = append(tags[hash], ref.Name().Short())
+		return nil
+	})
+	return tags
+}
+
+func newGitCommit(commit *object.Commit, tags map[plumbing.Hash][]string) *GitCommit {
+	result := &GitCommit{
+		Hash:      commit.Hash.String(),
+		ShortHash: commit.Hash.String()[:7],
+		Summary:   strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0],
+		Message:   commit.Message,
+		Author:    GitPerson{Name: commit.Author.Name, Email: commit.Author.Email, When: commit.Author.When},
+		Committer: GitPerson{Name: commit.Committer.Name, Email: commit.Committer.Email, When: commit.Committer.When},
+		Parents:   make([]string, 0, len(commit.ParentHashes)),
+		Tags:      tags[commit.Hash],
+	}
+	if result.Tags == nil {
+		result.Tags = make([]string, 0)
+	}
+	for _, parent := range commit.ParentHashes {
+		result.Parents = append(result.Parents, parent.String())
+	}
+	return result
+}
+
+// parseGitTime accepts RFC 3339 timestamps as well as plain dates. A plain date is the start of that day,
+// or its last moment with endOfDay so until=2024-01-02 includes the commits made on the 2nd.
+func parseGitTime(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return &parsed, nil
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		parsed = parsed.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return &parsed, nil
+}
+
+// cleanRepoPath turns a path param into a slash separated path relative to the repository root.
+func cleanRepoPath(value string) string {
+	return strings.Trim(filepath.ToSlash(filepath.Clean("/"+value)), "/")
+}
+
+// gitLogHandler lists the commits reachable from rev (HEAD by default), newest first. It can be limited
+// to commits touching a file or directory (path), by an author (matched against name and email), and to
+// a date range (since, until). Pages are selected with offset and limit.
+func gitLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	offset, limit := 0, DEFAULT_LOG_LIMIT
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Param offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > MAX_LOG_LIMIT {
+			http.Error(w, "Param limit must be between 1 and "+strconv.Itoa(MAX_LOG_LIMIT), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	since, err := parseGitTime(query.Get("since"), false)
+	if err != nil {
+		http.Error(w, "Param since must be a date (YYYY-MM-DD) or an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+	until, err := parseGitTime(query.Get("until"), true)
+	if err != nil {
+		http.Error(w, "Param until must be a date (YYYY-MM-DD) or an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rev := query.Get("rev")
+	if rev == "" {
+		rev = "HEAD"
+	}
+	from, err := resolveCommit(repo, rev)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown revision %s", rev), http.StatusNotFound)
+		return
+	}
+
+	options := &git.LogOptions{From: from.Hash, Since: since, Until: until}
+	if path := cleanRepoPath(query.Get("path")); path != "" {
+		options.PathFilter = func(file string) bool {
+			return file == path || strings.HasPrefix(file, path+"/")
+		}
+	}
+
+	commits, err := repo.Log(options)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read history: %s", err), http.StatusInternalServerError)
+		return
+	}
+	defer commits.Close()
+
+	author := strings.ToLower(query.Get("author"))
+	tags := commitTags(repo)
+	response := &GitLogResponse{Commits: make([]*GitCommit, 0), Offset: offset, Limit: limit}
+
+	skipped := 0
+	err = commits.ForEach(func(commit *object.Commit) error {
+		if author != "" && !strings.Contains(strings.ToLower(commit.Author.Name), author) && !strings.Contains(strings.ToLower(commit.Author.Email), author) {
+			return nil
+		}
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+		if len(response.Commits) == limit {
+			response.HasMore = true
+			return errLogPageFull
+		}
+		response.Commits = append(response.Commits, newGitCommit(commit, tags))
+		return nil
+	})
+	if err != nil && err != errLogPageFull && err != io.EOF {
+		log.Println("Failed to read history", err.Error())
+		http.Error(w, fmt.Sprintf("Failed to read history: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, response)
+}
+
+// gitShowHandler returns a commit along with how each file changed compared to its first parent.
+func gitShowHandler(w http.ResponseWriter, r *http.Request) {
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	commit, err := resolveCommit(repo, rev)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown revision %s", rev), http.StatusNotFound)
+		return
+	}
+
+	var parent *object.Commit
+	if commit.NumParents() > 0 {
+		parent, err = commit.Parent(0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read parent commit: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	pairs, err := commitDiffPairs(parent, commit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to diff commit: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := &GitShowResponse{
+		Commit: newGitCommit(commit, commitTags(repo)),
+		Files:  make([]*FileDiff, 0, len(pairs)),
+	}
+	for _, pair := range pairs {
+		response.Files = append(response.Files, buildFileDiff(pair, defaultDiffContext))
+	}
+
+	WriteJSONResponse(w, response)
+}
+
+// gitBlameHandler returns, for every line of path at rev (HEAD by default), the commit that last changed
+// it.
+func gitBlameHandler(w http.ResponseWriter, r *http.Request) {
+	path := cleanRepoPath(r.URL.Query().Get("path"))
+	if path == "" {
+		http.Error(w, "Param path is required", http.StatusBadRequest)
+		return
+	}
+
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	commit, err := resolveCommit(repo, rev)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown revision %s", rev), http.StatusNotFound)
+		return
+	}
+
+	file, err := commit.File(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s doesn't exist at %s", path, rev), http.StatusNotFound)
+		return
+	}
+	if binary, _ := file.IsBinary(); binary || file.Size > maxDiffFileBytes() {
+		http.Error(w, "Can't blame binary or very large files", http.StatusUnprocessableEntity)
+		return
+	}
+
+	result, err := git.Blame(commit, path)
+	if err != nil {
+		log.Println("Failed to blame", path, err.Error())
+		http.Error(w, fmt.Sprintf("Failed to blame %s: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+
+	response := &GitBlameResponse{Path: path, Rev: commit.Hash.String(), Lines: make([]*BlameLine, 0, len(result.Lines))}
+	for i, line := range result.Lines {
+		response.Lines = append(response.Lines, &BlameLine{
+			Line:        i + 1,
+			Text:        line.Text,
+			Hash:        line.Hash.String(),
+			Author:      line.AuthorName,
+			AuthorEmail: line.Author,
+			When:        line.Date,
+		})
+	}
+
+	WriteJSONResponse(w, response)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseGitTime(t *testing.T) {
+	since, err := parseGitTime("2024-01-02", false)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), *since)
+
+	until, err := parseGitTime("2024-01-02", true)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 1, 2, 23, 59, 59, 999999999, time.UTC), *until)
+
+	// Timestamps are taken as they are
+	until, err = parseGitTime("2024-01-02T10:00:00Z", true)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), *until)
+
+	_, err = parseGitTime("yesterday", false)
+	assert.NotNil(t, err)
+}
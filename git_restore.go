@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type RestoreSafety string
+
+const (
+	// The current state is put on the stash and applied again, so the branch history stays untouched
+	RestoreSafetyStash RestoreSafety = "stash"
+	// The current state is committed to the current branch
+	RestoreSafetyCommit RestoreSafety = "commit"
+	// There was nothing to save, the current state is HEAD
+	RestoreSafetyNone RestoreSafety = "none"
+)
+
+type RestoreRequest struct {
+	// Rev is the commit, tag or branch to restore from
+	Rev string `json:"rev"`
+	// Path is the file or directory to restore, the whole worktree when empty
+	Path   string        `json:"path"`
+	Safety RestoreSafety `json:"safety"`
+}
+
+type RestoreSafetyPoint struct {
+	Type RestoreSafety `json:"type"`
+	// Ref is the stash commit or commit holding the state before the restore. It's always a SHA, names like
+	// stash@{0} or HEAD would point somewhere else after the next stash or commit.
+	Ref     string `json:"ref,omitempty"`
+	Hash    string `json:"hash"`
+	Message string `json:"message,omitempty"`
+}
+
+type RestoredFile struct {
+	Path   string    `json:"path"`
+	Change GitChange `json:"change"`
+}
+
+type RestoreResponse struct {
+	Rev    string              `json:"rev"`
+	Path   string              `json:"path"`
+	Safety *RestoreSafetyPoint `json:"safety"`
+	Files  []*RestoredFile     `json:"files"`
+}
+
+// saveRestorePoint records the current state of the worktree, including untracked files, before it gets
+// overwritten. The caller holds gitLock.
+func saveRestorePoint(runner *CommandRunner, safety RestoreSafety, rev string) (*RestoreSafetyPoint, error) {
+	message := fmt.Sprintf("fermat: before restoring %s (%s)", rev, time.Now().Format(time.RFC3339))
+
+	runner.Run("git", "status", "--porcelain")
+	if runner.err != nil {
+		return nil, runner.err
+	}
+	if strings.TrimSpace(runner.output) == "" {
+		runner.Run("git", "rev-parse", "HEAD")
+		hash := strings.TrimSpace(runner.output)
+		return &RestoreSafetyPoint{Type: RestoreSafetyNone, Ref: hash, Hash: hash}, runner.err
+	}
+
+	point := &RestoreSafetyPoint{Type: safety, Message: message}
+	if safety == RestoreSafetyCommit {
+		runner.Run("git", "add", "--all")
+		runner.Run("git", "commit", "--no-verify", "-m", message)
+		runner.Run("git", "rev-parse", "HEAD")
+		if runner.err != nil {
+			return nil, runner.err
+		}
+		point.Hash = strings.TrimSpace(runner.output)
+		point.Ref = point.Hash
+		return point, nil
+	}
+
+	// Stashing and applying again leaves the worktree as it was, with its state saved in the stash
+	runner.Run("git", "stash", "push", "--include-untracked", "-m", message)
+	runner.Run("git", "rev-parse", "stash@{0}")
+	if runner.err != nil {
+		return nil, runner.err
+	}
+	point.Hash = strings.TrimSpace(runner.output)
+	point.Ref = point.Hash
+
+	runner.Run("git", "stash", "apply", "--index", point.Hash)
+	if runner.err != nil {
+		// --index gives up when the staged changes can't be restored as they were. Applying without it
+		// still brings every change back, they just end up unstaged.
+		log.Printf("[Warn] Failed to apply stash %s with its index, applying it without: %v", point.Hash, runner.err)
+		runner.err = nil
+		runner.Run("git", "stash", "apply", point.Hash)
+	}
+	if runner.err != nil {
+		return nil, fmt.Errorf("The changes were stashed as %s but couldn't be applied again, 'git stash apply %s' brings them back: %v", point.Hash, point.Hash, runner.err)
+	}
+	return point, nil
+}
+
+// restoredFiles lists the tracked files that differ between the safety point and the worktree.
+func restoredFiles(runner *CommandRunner, from string, path string) ([]*RestoredFile, error) {
+	runner.Run("git", "diff", "--name-status", "--no-renames", "-z", from, "--", path)
+	if runner.err != nil {
+		return nil, runner.err
+	}
+
+	files := make([]*RestoredFile, 0)
+	fields := strings.Split(strings.TrimSuffix(runner.output, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		change := GitModified
+		switch fields[i] {
+		case "A":
+			change = GitAdded
+		case "D":
+			change = GitDeleted
+		}
+		files = append(files, &RestoredFile{Path: fields[i+1], Change: change})
+	}
+	return files, nil
+}
+
+// restoreHandler puts a path, or the whole worktree, back to how it was at a commit or tag. HEAD doesn't
+// move, the restored content shows up as uncommitted changes. Before anything is overwritten the current
+// state is saved on the stash (or committed with safety=commit), which is how a restore gets undone.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Rev == "" {
+		http.Error(w, "Field rev is required", http.StatusBadRequest)
+		return
+	}
+	if req.Safety == "" {
+		req.Safety = RestoreSafetyStash
+	}
+	if req.Safety != RestoreSafetyStash && req.Safety != RestoreSafetyCommit {
+		http.Error(w, "Field safety must be stash or commit", http.StatusBadRequest)
+		return
+	}
+
+	path := cleanRepoPath(req.Path)
+	if path == ".git" || strings.HasPrefix(path, ".git/") {
+		http.Error(w, "Can't restore files inside .git", http.StatusBadRequest)
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openRepo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open repository: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		http.Error(w, "There are no commits to restore from", http.StatusConflict)
+		return
+	}
+	if req.Safety == RestoreSafetyCommit {
+		if !head.Name().IsBranch() {
+			http.Error(w, "HEAD is detached, use safety=stash", http.StatusConflict)
+			return
+		}
+		if isProtectedBranch(head.Name().Short()) {
+			http.Error(w, fmt.Sprintf("%s is a protected branch, use safety=stash", head.Name().Short()), http.StatusForbidden)
+			return
+		}
+	}
+
+	commit, err := resolveCommit(repo, req.Rev)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown revision %s", req.Rev), http.StatusNotFound)
+		return
+	}
+
+	if path != "" {
+		tree, err := commit.Tree()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read commit: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if _, err := tree.FindEntry(path); err != nil && !fileExists(filepath.Join(root, filepath.FromSlash(path))) {
+			http.Error(w, fmt.Sprintf("%s doesn't exist at %s or in the workspace", path, req.Rev), http.StatusNotFound)
+			return
+		}
+	}
+
+	runner := &CommandRunner{dir: root}
+	safety, err := saveRestorePoint(runner, req.Safety, req.Rev)
+	if err != nil {
+		log.Println("Failed to save the workspace before restoring", err.Error())
+		http.Error(w, fmt.Sprintf("Failed to save the workspace before restoring: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	pathspec := path
+	if pathspec == "" {
+		pathspec = "."
+	}
+
+	// Without overlay mode tracked files that don't exist at rev get removed, untracked files are left alone
+	runner.Run("git", "restore", "--source", commit.Hash.String(), "--staged", "--worktree", "--", pathspec)
+	if runner.err != nil {
+		log.Println("Failed to restore", pathspec, runner.err.Error())
+		http.Error(w, runner.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	files, err := restoredFiles(runner, safety.Hash, pathspec)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Restored, but failed to list the changes: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, &RestoreResponse{
+		Rev:    commit.Hash.String(),
+		Path:   path,
+		Safety: safety,
+		Files:  files,
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// initRestoreRepo makes a second commit that changes server.js and adds app.js, then leaves server.js
+// modified and an untracked file in the worktree.
+func initRestoreRepo(t *testing.T) string {
+	root := initTestRepo(t)
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "server.js"), []byte("console.log('two')\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "app.js"), []byte("export default {}\n"), 0644))
+	runTestGit(t, root, "add", "--all")
+	runTestGit(t, root, "commit", "-m", "second")
+
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "server.js"), []byte("console.log('three')\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "notes.md"), []byte("untracked\n"), 0644))
+	return root
+}
+
+func restore(t *testing.T, body string) (int, *RestoreResponse) {
+	w := httptest.NewRecorder()
+	restoreHandler(w, httptest.NewRequest(http.MethodPost, "/git/restore", strings.NewReader(body)))
+
+	response := &RestoreResponse{}
+	if w.Code == http.StatusOK {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), response))
+	}
+	return w.Code, response
+}
+
+func Test_RestorePath(t *testing.T) {
+	root := initRestoreRepo(t)
+
+	status, response := restore(t, `{"rev": "HEAD~1", "path": "server.js"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []*RestoredFile{{Path: "server.js", Change: GitModified}}, response.Files)
+
+	content, _ := os.ReadFile(filepath.Join(root, "server.js"))
+	assert.Equal(t, "console.log('one')\n", string(content))
+	assert.True(t, fileExists(filepath.Join(root, "app.js")))
+	assert.True(t, fileExists(filepath.Join(root, "notes.md")))
+
+	// The safety point still has the state from before the restore after more stashes are pushed
+	assert.Equal(t, RestoreSafetyStash, response.Safety.Type)
+	assert.Equal(t, response.Safety.Hash, response.Safety.Ref)
+	runTestGit(t, root, "stash", "push", "--include-untracked")
+	assert.Equal(t, "console.log('three')", runTestGit(t, root, "show", response.Safety.Ref+":server.js"))
+}
+
+func Test_RestoreWorktree(t *testing.T) {
+	root := initRestoreRepo(t)
+	head := runTestGit(t, root, "rev-parse", "HEAD")
+
+	status, response := restore(t, `{"rev": "HEAD~1", "safety": "commit"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []*RestoredFile{
+		{Path: "app.js", Change: GitDeleted},
+		{Path: "notes.md", Change: GitDeleted},
+		{Path: "server.js", Change: GitModified},
+	}, response.Files)
+
+	assert.False(t, fileExists(filepath.Join(root, "app.js")))
+	content, _ := os.ReadFile(filepath.Join(root, "server.js"))
+	assert.Equal(t, "console.log('one')\n", string(content))
+
+	// The state from before was committed on top of the old HEAD
+	assert.Equal(t, RestoreSafetyCommit, response.Safety.Type)
+	assert.Equal(t, runTestGit(t, root, "rev-parse", "HEAD"), response.Safety.Ref)
+	assert.Equal(t, head, runTestGit(t, root, "rev-parse", "HEAD~1"))
+	assert.Equal(t, "console.log('three')", runTestGit(t, root, "show", "HEAD:server.js"))
+}
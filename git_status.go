@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Untracked files bigger than this aren't hashed when looking for renames.
+const maxRenameDetectBytes = 5 << 20
+
+type GitChange string
+
+const (
+	GitUnmodified GitChange = ""
+	GitModified   GitChange = "modified"
+	GitAdded      GitChange = "added"
+	GitDeleted    GitChange = "deleted"
+	GitRenamed    GitChange = "renamed"
+	GitCopied     GitChange = "copied"
+)
+
+// GitFileStatus is the state of one path. Staged compares the index with HEAD and Unstaged compares the
+// working tree with the index, like the two columns of `git status --short`.
+type GitFileStatus struct {
+	Path       string    `json:"path"`
+	OldPath    string    `json:"oldPath,omitempty"`
+	Staged     GitChange `json:"staged"`
+	Unstaged   GitChange `json:"unstaged"`
+	Untracked  bool      `json:"untracked"`
+	Conflicted bool      `json:"conflicted"`
+}
+
+type GitStatusResponse struct {
+	Branch           string           `json:"branch"`
+	Detached         bool             `json:"detached"`
+	Head             string           `json:"head"`
+	Upstream         string           `json:"upstream,omitempty"`
+	Ahead            int              `json:"ahead"`
+	Behind           int              `json:"behind"`
+	MergeInProgress  bool             `json:"mergeInProgress"`
+	RebaseInProgress bool             `json:"rebaseInProgress"`
+	Clean            bool             `json:"clean"`
+	Files            []*GitFileStatus `json:"files"`
+}
+
+func gitChange(code git.StatusCode) GitChange {
+	switch code {
+	case git.Modified:
+		return GitModified
+	case git.Added:
+		return GitAdded
+	case git.Deleted:
+		return GitDeleted
+	case git.Renamed:
+		return GitRenamed
+	case git.Copied:
+		return GitCopied
+	}
+	return GitUnmodified
+}
+
+// reachableCommits returns every commit reachable from hash.
+func reachableCommits(repo *git.Repository, hash plumbing.Hash) (map[plumbing.Hash]bool, error) {
+	seen := make(map[plumbing.Hash]bool)
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = object.NewCommitPreorderIter(commit, nil, nil).ForEach(func(c *object.Commit) error {
+		seen[c.Hash] = true
+		return nil
+	})
+	return seen, err
+}
+
+// aheadBehind counts the commits only reachable from local and only reachable from remote.
+func aheadBehind(repo *git.Repository, local plumbing.Hash, remote plumbing.Hash) (int, int, error) {
+	if local == remote {
+		return 0, 0, nil
+	}
+
+	localCommits, err := reachableCommits(repo, local)
+	if err != nil {
+		return 0, 0, err
+	}
+	remoteCommits, err := reachableCommits(repo, remote)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ahead, behind := 0, 0
+	for hash := range localCommits {
+		if !remoteCommits[hash] {
+			ahead++
+		}
+	}
+	for hash := range remoteCommits {
+		if !localCommits[hash] {
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
+
+// detectRenames folds a deleted path and an added path with identical content into a single rename, both
+// for staged changes (index vs HEAD) and for unstaged ones (an untracked file vs a file missing from the
+// working tree). Like git, only the content matters, so a rename with edits shows up as delete + add.
+func detectRenames(repo *git.Repository, root string, files map[string]*GitFileStatus) error {
+	index, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+
+	var headTree *object.Tree
+	if head, err := repo.Head(); err == nil {
+		if commit, err := repo.CommitObject(head.Hash()); err == nil {
+			headTree, _ = commit.Tree()
+		}
+	}
+
+	stagedAdds := make(map[plumbing.Hash]*GitFileStatus)
+	untracked := make(map[plumbing.Hash]*GitFileStatus)
+	unstagedDeletes := make([]*GitFileStatus, 0)
+	stagedDeletes := make([]*GitFileStatus, 0)
+
+	for _, file := range files {
+		switch {
+		case file.Staged == GitAdded:
+			if entry, err := index.Entry(file.Path); err == nil {
+				stagedAdds[entry.Hash] = file
+			}
+		case file.Staged == GitDeleted:
+			stagedDeletes = append(stagedDeletes, file)
+		case file.Unstaged == GitDeleted:
+			unstagedDeletes = append(unstagedDeletes, file)
+		}
+	}
+
+	if headTree != nil {
+		for _, deleted := range stagedDeletes {
+			old, err := headTree.File(deleted.Path)
+			if err != nil {
+				continue
+			}
+			if added, ok := stagedAdds[old.Hash]; ok {
+				delete(stagedAdds, old.Hash)
+				added.Staged = GitRenamed
+				added.OldPath = deleted.Path
+				delete(files, deleted.Path)
+			}
+		}
+	}
+
+	if len(unstagedDeletes) == 0 {
+		return nil
+	}
+
+	for _, file := range files {
+		if !file.Untracked {
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(file.Path))
+		if info, err := os.Stat(path); err != nil || info.Size() > maxRenameDetectBytes {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		untracked[plumbing.ComputeHash(plumbing.BlobObject, content)] = file
+	}
+
+	for _, deleted := range unstagedDeletes {
+		entry, err := index.Entry(deleted.Path)
+		if err != nil {
+			continue
+		}
+		if added, ok := untracked[entry.Hash]; ok {
+			delete(untracked, entry.Hash)
+			added.Untracked = false
+			added.Unstaged = GitRenamed
+			added.OldPath = deleted.Path
+			delete(files, deleted.Path)
+		}
+	}
+
+	return nil
+}
+
+// workingTreeChanges returns every path that differs between HEAD, the index and the working tree,
+// with renames already folded together.
+func workingTreeChanges(repo *git.Repository, root string) (map[string]*GitFileStatus, error) {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*GitFileStatus)
+	for path, fileStatus := range status {
+		if fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Unmodified {
+			continue
+		}
+		file := &GitFileStatus{Path: path}
+		if fileStatus.Worktree == git.Untracked {
+			file.Untracked = true
+		} else {
+			file.Staged = gitChange(fileStatus.Staging)
+			file.Unstaged = gitChange(fileStatus.Worktree)
+		}
+		files[path] = file
+	}
+
+	// go-git doesn't report unmerged paths, they're the index entries with a non-zero stage.
+	if index, err := repo.Storer.Index(); err == nil {
+		for _, entry := range index.Entries {
+			if entry.Stage == 0 {
+				continue
+			}
+			file, ok := files[entry.Name]
+			if !ok {
+				file = &GitFileStatus{Path: entry.Name}
+				files[entry.Name] = file
+			}
+			file.Conflicted = true
+		}
+	}
+
+	if err := detectRenames(repo, root, files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func getGitStatus() (*GitStatusResponse, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GitStatusResponse{Files: make([]*GitFileStatus, 0)}
+
+	head, err := repo.Head()
+	switch {
+	case err == nil:
+		response.Head = head.Hash().String()
+		if head.Name().IsBranch() {
+			response.Branch = head.Name().Short()
+		} else {
+			response.Detached = true
+		}
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		// A fresh repository without commits, HEAD still says which branch the first commit goes to
+		if ref, err := repo.Storer.Reference(plumbing.HEAD); err == nil {
+			response.Branch = ref.Target().Short()
+		}
+	default:
+		return nil, err
+	}
+
+	if response.Branch != "" && head != nil {
+		upstream := plumbing.NewRemoteReferenceName("origin", response.Branch)
+		if remote, err := repo.Reference(upstream, true); err == nil {
+			response.Upstream = upstream.Short()
+			response.Ahead, response.Behind, err = aheadBehind(repo, head.Hash(), remote.Hash())
+			if err != nil {
+				log.Printf("Failed to compare %s with %s: %v", response.Branch, upstream.Short(), err)
+			}
+		}
+	}
+
+	gitDir := filepath.Join(root, ".git")
+	response.MergeInProgress = fileExists(filepath.Join(gitDir, "MERGE_HEAD"))
+	response.RebaseInProgress = fileExists(filepath.Join(gitDir, "rebase-merge")) || fileExists(filepath.Join(gitDir, "rebase-apply"))
+
+	files, err := workingTreeChanges(repo, root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		response.Files = append(response.Files, file)
+	}
+	sort.Slice(response.Files, func(i, j int) bool { return response.Files[i].Path < response.Files[j].Path })
+	response.Clean = len(response.Files) == 0
+
+	return response, nil
+}
+
+func gitStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := getGitStatus()
+	if err != nil {
+		log.Println("Failed to get git status", err.Error())
+		http.Error(w, "Failed to get git status: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, status)
+}
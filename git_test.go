@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PushProductionRequiresMaster(t *testing.T) {
+	root := initTestRepo(t)
+	runTestGit(t, root, "switch", "-c", "feature")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/push_to_production", strings.NewReader(`{}`))
+	pushProduction(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "HEAD is on feature")
+	assert.Nil(t, activeDeployJob())
+
+	runTestGit(t, root, "switch", "--detach", "master")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/push_to_production", strings.NewReader(`{}`))
+	pushProduction(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "HEAD is detached")
+
+	// HEAD can move after the request was accepted, the job checks again before committing anything
+	job, running := startDeployJob(JobPushProduction)
+	assert.Nil(t, running)
+	response := runPushProduction(root, &PushProductionRequest{}, job)
+	job.Finish(response)
+	assert.Equal(t, Failed, response.Status)
+	assert.Equal(t, "", runTestGit(t, root, "status", "--porcelain"))
+}
+
+// initTestOrigin adds a bare origin to the test repository that accepts push options like the real one.
+func initTestOrigin(t *testing.T, root string) string {
+	origin := filepath.Join(t.TempDir(), "origin.git")
+	runTestGit(t, root, "init", "--bare", origin)
+	runTestGit(t, origin, "config", "receive.advertisePushOptions", "true")
+	runTestGit(t, root, "remote", "add", "origin", origin)
+	runTestGit(t, root, "push", "origin", "master")
+	return origin
+}
+
+func Test_RunPushProduction(t *testing.T) {
+	root := initTestRepo(t)
+	origin := initTestOrigin(t, root)
+	t.Setenv("FERMAT_PREDEPLOY_CHECKS", "secrets")
+
+	deploy := func() *PushProductionResponse {
+		job, running := startDeployJob(JobPushProduction)
+		assert.Nil(t, running)
+		response := runPushProduction(root, &PushProductionRequest{}, job)
+		job.Finish(response)
+		return response
+	}
+
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "app.js"), []byte("export default {}\n"), 0644))
+	response := deploy()
+	assert.Equal(t, BuildTriggered, response.Status)
+	assert.Equal(t, response.Commit, runTestGit(t, origin, "rev-parse", "release"))
+	assert.Equal(t, response.Commit, runTestGit(t, origin, "rev-parse", response.Tag+"^{commit}"))
+
+	// Nothing new is neither tagged nor counted as a deployment with changes
+	response = deploy()
+	assert.Equal(t, NoChanges, response.Status)
+	assert.Equal(t, "", response.Tag)
+
+	// A secret in the changes stops the deploy before they're committed
+	head := runTestGit(t, root, "rev-parse", "HEAD")
+	assert.Nil(t, os.WriteFile(filepath.Join(root, ".env"), []byte("TOKEN=abc\n"), 0644))
+	response = deploy()
+	assert.Equal(t, ChecksFailed, response.Status)
+	assert.Equal(t, head, runTestGit(t, root, "rev-parse", "HEAD"))
+	assert.Nil(t, os.Remove(filepath.Join(root, ".env")))
+
+	// Without origin nothing can be pushed, the tag made for the push is removed again
+	runTestGit(t, root, "remote", "set-url", "origin", filepath.Join(t.TempDir(), "missing.git"))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "app.js"), []byte("export default { two: 2 }\n"), 0644))
+	response = deploy()
+	assert.Equal(t, Failed, response.Status)
+	assert.Equal(t, "", runTestGit(t, root, "tag", "--list", "deploy-*", "--contains", "HEAD"))
+
+	deploymentsLock.Lock()
+	deployments, err := readDeploymentsLocked()
+	deploymentsLock.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(deployments))
+	// The first release counts everything as added
+	assert.Equal(t, 2, deployments[0].DiffStat.FilesChanged)
+	assert.Nil(t, deployments[3].DiffStat)
+}
+
+func Test_RunPushProductionCommitFails(t *testing.T) {
+	root := initTestRepo(t)
+	origin := initTestOrigin(t, root)
+	t.Setenv("FERMAT_PREDEPLOY_CHECKS", "secrets")
+
+	// A hook that refuses the commit fails the deploy instead of releasing master without the changes
+	hook := filepath.Join(root, ".git", "hooks", "pre-commit")
+	assert.Nil(t, os.WriteFile(hook, []byte("#!/bin/sh\necho 'lint failed'\nexit 1\n"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "app.js"), []byte("export default {}\n"), 0644))
+
+	job, running := startDeployJob(JobPushProduction)
+	assert.Nil(t, running)
+	response := runPushProduction(root, &PushProductionRequest{}, job)
+	job.Finish(response)
+	assert.Equal(t, Failed, response.Status)
+	assert.Contains(t, response.Message, "lint failed")
+	assert.Equal(t, "", runTestGit(t, origin, "branch", "--list", "release"))
+}
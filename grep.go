@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Grep results are capped at DEFAULT_GREP_MAX_RESULTS unless the client asks for fewer (or up to
+// MAX_GREP_RESULTS more). Files bigger than FERMAT_GREP_MAX_FILE_BYTES are skipped like binaries are.
+const (
+	DEFAULT_GREP_MAX_RESULTS    = 1000
+	MAX_GREP_RESULTS            = 20000
+	DEFAULT_GREP_MAX_FILE_BYTES = 5 << 20
+)
+
+// Lines longer than this are cut down in the result, minified bundles would otherwise blow up a stream.
+const maxGrepLineLength = 500
+
+// grepOptions describes a search over the workspace. It's shared by /code/grep and find/replace.
+type grepOptions struct {
+	Query         string
+	Regex         bool
+	CaseSensitive bool
+	WholeWord     bool
+	Include       []string
+	Exclude       []string
+	// Dir limits the search to a directory of the workspace
+	Dir string
+}
+
+// grepMatcher is a compiled grepOptions.
+type grepMatcher struct {
+	pattern *regexp.Regexp
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// GrepRange is where a match sits inside GrepMatch.Text, in 0-based rune offsets. End is exclusive.
+type GrepRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// GrepMatch is one matching line. Line is 1-based.
+type GrepMatch struct {
+	Type      string      `json:"type"`
+	Path      string      `json:"path"`
+	Line      int         `json:"line"`
+	Text      string      `json:"text"`
+	Ranges    []GrepRange `json:"ranges"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// GrepSummary is always the last line of a grep stream.
+type GrepSummary struct {
+	Type         string `json:"type"`
+	Matches      int    `json:"matches"`
+	Files        int    `json:"files"`
+	FilesScanned int    `json:"filesScanned"`
+	Limited      bool   `json:"limited"`
+	Cancelled    bool   `json:"cancelled"`
+	Took         int64  `json:"took"`
+}
+
+// Running searches by the token the client picked, so a search can be cancelled from another request.
+var (
+	grepSearchesMu sync.Mutex
+	grepSearches   = make(map[string]context.CancelFunc)
+)
+
+func splitGlobs(value string) []string {
+	globs := make([]string, 0)
+	for _, glob := range strings.Split(value, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
+
+// compileGlobs turns file globs into regexps matched against slash separated workspace paths. Like in
+// a .gitignore, a glob without a slash (e.g. "*.ts") matches a file name at any depth.
+func compileGlobs(globs []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(globs))
+	for _, glob := range globs {
+		glob = strings.TrimSuffix(glob, "/")
+		expr := globToRegexp(strings.TrimPrefix(glob, "/"))
+		if !strings.Contains(glob, "/") {
+			expr = "(?:.*/)?" + expr
+		}
+		// A glob matching a directory matches everything inside of it too
+		pattern, err := regexp.Compile("^" + expr + "(?:/.*)?$")
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, pattern)
+	}
+	return compiled, nil
+}
+
+func (opts *grepOptions) compile() (*grepMatcher, error) {
+	expr := opts.Query
+	if !opts.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if opts.WholeWord {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	if !opts.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	// Matches never span lines, so ^ and $ should work per line
+	pattern, err := regexp.Compile("(?m)" + expr)
+	if err != nil {
+		return nil, err
+	}
+
+	include, err := compileGlobs(opts.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compileGlobs(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grepMatcher{pattern: pattern, include: include, exclude: exclude}, nil
+}
+
+// wantsFile applies the include and exclude globs to a slash separated workspace relative path.
+func (m *grepMatcher) wantsFile(rel string) bool {
+	for _, pattern := range m.exclude {
+		if pattern.MatchString(rel) {
+			return false
+		}
+	}
+	if len(m.include) == 0 {
+		return true
+	}
+	for _, pattern := range m.include {
+		if pattern.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkGrepFiles sends every regular, non-ignored file underneath dir that passes the globs to files. It
+// stops early when ctx is cancelled.
+func walkGrepFiles(ctx context.Context, root string, dir string, matcher *grepMatcher, files chan<- string) error {
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return nil
+		}
+		if path != dir && ignore.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || !matcher.wantsFile(filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		select {
+		case files <- path:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+}
+
+// readSearchableFile returns the content of a text file or false for binaries and big files.
+func readSearchableFile(path string) ([]byte, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > envInt64("FERMAT_GREP_MAX_FILE_BYTES", DEFAULT_GREP_MAX_FILE_BYTES) {
+		return nil, false
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || isBinaryContent(content) {
+		return nil, false
+	}
+	return content, true
+}
+
+// grepContent returns every line of content that matches, along with where in the line it matched.
+func (m *grepMatcher) grepContent(rel string, content []byte) []*GrepMatch {
+	locations := m.pattern.FindAllIndex(content, -1)
+	if len(locations) == 0 {
+		return nil
+	}
+
+	matches := make([]*GrepMatch, 0)
+	lineNumber, lineStart := 1, 0
+	var current *GrepMatch
+
+	for _, location := range locations {
+		// Empty matches (e.g. "^") don't tell the user anything
+		if location[0] == location[1] {
+			continue
+		}
+
+		for {
+			end := bytes.IndexByte(content[lineStart:], '\n')
+			if end < 0 || lineStart+end >= location[0] {
+				break
+			}
+			lineStart += end + 1
+			lineNumber++
+		}
+
+		lineEnd := len(content)
+		if end := bytes.IndexByte(content[lineStart:], '\n'); end >= 0 {
+			lineEnd = lineStart + end
+		}
+		line := strings.TrimSuffix(string(content[lineStart:lineEnd]), "\r")
+
+		if current == nil || current.Line != lineNumber {
+			current = &GrepMatch{Type: "match", Path: rel, Line: lineNumber, Ranges: make([]GrepRange, 0)}
+			current.Text = line
+			if utf8.RuneCountInString(line) > maxGrepLineLength {
+				current.Text = string([]rune(line)[:maxGrepLineLength])
+				current.Truncated = true
+			}
+			matches = append(matches, current)
+		}
+
+		// A regex like \s+ can run into the next line, the range stops at the end of this one.
+		matchEnd := location[1]
+		if matchEnd > lineEnd {
+			matchEnd = lineEnd
+		}
+		start := utf8.RuneCount(content[lineStart:location[0]])
+		end := start + utf8.RuneCount(content[location[0]:matchEnd])
+		if start >= maxGrepLineLength {
+			continue
+		}
+		if end > maxGrepLineLength {
+			end = maxGrepLineLength
+		}
+		current.Ranges = append(current.Ranges, GrepRange{Start: start, End: end})
+	}
+
+	return matches
+}
+
+func parseGrepOptions(r *http.Request) (*grepOptions, error) {
+	query := r.URL.Query()
+	opts := &grepOptions{
+		Query:   query.Get("q"),
+		Include: splitGlobs(query.Get("include")),
+		Exclude: splitGlobs(query.Get("exclude")),
+		Dir:     query.Get("path"),
+	}
+
+	flags := map[string]*bool{
+		"regex":          &opts.Regex,
+		"case_sensitive": &opts.CaseSensitive,
+		"whole_word":     &opts.WholeWord,
+	}
+	for name, flag := range flags {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("Param " + name + " must be true or false")
+			}
+			*flag = parsed
+		}
+	}
+	return opts, nil
+}
+
+// grepHandler streams every line in the workspace matching q as newline delimited JSON, followed by a
+// summary. Files are searched concurrently, so results are grouped per file but files come in no
+// particular order. Passing a token lets the search be cancelled with DELETE /code/grep/{token}.
+func grepHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseGrepOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Query == "" {
+		http.Error(w, "Param q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := DEFAULT_GREP_MAX_RESULTS
+	if value := r.URL.Query().Get("max_results"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > MAX_GREP_RESULTS {
+			http.Error(w, "Param max_results must be between 1 and "+strconv.Itoa(MAX_GREP_RESULTS), http.StatusBadRequest)
+			return
+		}
+	}
+
+	matcher, err := opts.compile()
+	if err != nil {
+		http.Error(w, "Invalid search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+	dir, err := resolveWorkspacePath(opts.Dir)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		grepSearchesMu.Lock()
+		if _, exists := grepSearches[token]; exists {
+			grepSearchesMu.Unlock()
+			http.Error(w, "A search with this token is already running", http.StatusConflict)
+			return
+		}
+		grepSearches[token] = cancel
+		grepSearchesMu.Unlock()
+
+		defer func() {
+			grepSearchesMu.Lock()
+			delete(grepSearches, token)
+			grepSearchesMu.Unlock()
+		}()
+	}
+
+	started := time.Now()
+	files := make(chan string, 256)
+	results := make(chan []*GrepMatch, 64)
+
+	go func() {
+		defer close(files)
+		if err := walkGrepFiles(ctx, root, dir, matcher, files); err != nil && ctx.Err() == nil {
+			log.Printf("Error walking workspace for grep: %v", err)
+		}
+	}()
+
+	var scanned sync.WaitGroup
+	var scannedMu sync.Mutex
+	filesScanned := 0
+	for i := 0; i < runtime.NumCPU(); i++ {
+		scanned.Add(1)
+		go func() {
+			defer scanned.Done()
+			for path := range files {
+				content, ok := readSearchableFile(path)
+				if !ok {
+					continue
+				}
+				scannedMu.Lock()
+				filesScanned++
+				scannedMu.Unlock()
+
+				rel, _ := filepath.Rel(root, path)
+				if matches := matcher.grepContent(filepath.ToSlash(rel), content); len(matches) > 0 {
+					select {
+					case results <- matches:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		scanned.Wait()
+		close(results)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+
+	summary := &GrepSummary{Type: "done"}
+	for matches := range results {
+		if summary.Limited {
+			continue
+		}
+
+		summary.Files++
+		for _, match := range matches {
+			if summary.Matches == limit {
+				summary.Limited = true
+				cancel()
+				break
+			}
+			summary.Matches++
+			encoder.Encode(match)
+		}
+
+		// Flush once per file so results show up while the search is still running.
+		if out.Flush() != nil {
+			cancel()
+			continue
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	summary.Cancelled = ctx.Err() != nil && !summary.Limited
+	summary.FilesScanned = filesScanned
+	summary.Took = time.Since(started).Milliseconds()
+	encoder.Encode(summary)
+	out.Flush()
+}
+
+// cancelGrepHandler stops a running search started with the given token. The search answers with its
+// summary right away.
+func cancelGrepHandler(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+
+	grepSearchesMu.Lock()
+	cancel, ok := grepSearches[token]
+	grepSearchesMu.Unlock()
+
+	if !ok {
+		http.Error(w, "No running search with this token", http.StatusNotFound)
+		return
+	}
+
+	cancel()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Search cancelled"))
+}
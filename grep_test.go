@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GrepContent(t *testing.T) {
+	opts := &grepOptions{Query: "process.env.MONGO_"}
+	matcher, err := opts.compile()
+	assert.Nil(t, err)
+
+	content := []byte("const url = process.env.MONGO_URL;\nconst db = \"x\";\r\nconst é = PROCESS.ENV.MONGO_DB + process.env.MONGO_USER;\n")
+	matches := matcher.grepContent("backend/db.js", content)
+	assert.Equal(t, 2, len(matches))
+	assert.Equal(t, 1, matches[0].Line)
+	assert.Equal(t, []GrepRange{{Start: 12, End: 30}}, matches[0].Ranges)
+	assert.Equal(t, 3, matches[1].Line)
+	assert.Equal(t, []GrepRange{{Start: 10, End: 28}, {Start: 33, End: 51}}, matches[1].Ranges)
+
+	opts = &grepOptions{Query: "const", CaseSensitive: true, WholeWord: true, Regex: true}
+	matcher, err = opts.compile()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(matcher.grepContent("backend/db.js", content)))
+	assert.Nil(t, matcher.grepContent("backend/db.js", []byte("constant = 1")))
+}
+
+func Test_GrepGlobs(t *testing.T) {
+	opts := &grepOptions{Query: "x", Include: []string{"*.ts", "backend/"}, Exclude: []string{"**/*.test.ts"}}
+	matcher, err := opts.compile()
+	assert.Nil(t, err)
+
+	assert.True(t, matcher.wantsFile("frontend/src/App.ts"))
+	assert.True(t, matcher.wantsFile("backend/server.js"))
+	assert.False(t, matcher.wantsFile("frontend/src/App.test.ts"))
+	assert.False(t, matcher.wantsFile("frontend/src/App.js"))
+}
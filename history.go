@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local history keeps every save made through fermat so edits between git commits can be recovered. It
+// is bounded per file by FERMAT_HISTORY_MAX_REVISIONS and overall by FERMAT_HISTORY_MAX_BYTES. Files
+// bigger than FERMAT_HISTORY_MAX_FILE_BYTES (think videos in frontend/public) aren't tracked at all.
+const (
+	DEFAULT_HISTORY_MAX_REVISIONS  = 50
+	DEFAULT_HISTORY_MAX_BYTES      = 256 << 20
+	DEFAULT_HISTORY_MAX_FILE_BYTES = 5 << 20
+)
+
+type HistorySource string
+
+const (
+	HistoryDisk    HistorySource = "disk"
+	HistoryWrite   HistorySource = "write"
+	HistoryUpload  HistorySource = "upload"
+	HistoryPatch   HistorySource = "patch"
+	HistoryReplace HistorySource = "replace"
+	HistoryRestore HistorySource = "restore"
+	HistoryImport  HistorySource = "import"
+)
+
+// FileRevision is one saved version of a file. ID is the sha256 of the content, which is also where the
+// content lives in the object store so identical versions are only stored once.
+type FileRevision struct {
+	ID      string        `json:"id"`
+	SavedAt time.Time     `json:"savedAt"`
+	Size    int64         `json:"size"`
+	Source  HistorySource `json:"source"`
+}
+
+type fileHistory struct {
+	Path      string          `json:"path"`
+	Revisions []*FileRevision `json:"revisions"`
+}
+
+var historyIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var historyLock sync.Mutex
+
+// historyUsage is the size of the object store in dir, kept as a running total so a save doesn't have to
+// walk the whole store. It's counted from disk the first time it's needed. Guarded by historyLock.
+var historyUsage struct {
+	dir   string
+	bytes int64
+}
+
+func historyDir(parts ...string) (string, error) {
+	return fermatStateDir(append([]string{"history"}, parts...)...)
+}
+
+// historyIndexPath is the per-file list of revisions, named after the hash of the file's path.
+func historyIndexPath(path string) (string, error) {
+	dir, err := historyDir("files")
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+func loadFileHistoryLocked(path string) (*fileHistory, error) {
+	indexPath, err := historyIndexPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &fileHistory{Path: path}
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func saveFileHistoryLocked(history *fileHistory) error {
+	indexPath, err := historyIndexPath(history.Path)
+	if err != nil {
+		return err
+	}
+
+	if len(history.Revisions) == 0 {
+		err := os.Remove(indexPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(indexPath, data)
+}
+
+// recordFileRevision stores content as the newest revision of path. Saving the same content twice in a
+// row is a no-op. Failures are only logged since history must never get in the way of a save.
+func recordFileRevision(path string, content []byte, source HistorySource) {
+	if int64(len(content)) > envInt64("FERMAT_HISTORY_MAX_FILE_BYTES", DEFAULT_HISTORY_MAX_FILE_BYTES) {
+		return
+	}
+
+	if err := recordFileRevisionErr(path, content, source); err != nil {
+		log.Printf("[Error] Failed to record history for %s: %v", path, err)
+	}
+}
+
+func recordFileRevisionErr(path string, content []byte, source HistorySource) error {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	history, err := loadFileHistoryLocked(path)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(content)
+	id := hex.EncodeToString(sum[:])
+	if n := len(history.Revisions); n > 0 && history.Revisions[n-1].ID == id {
+		return nil
+	}
+
+	objects, err := historyDir("objects")
+	if err != nil {
+		return err
+	}
+	objectPath := filepath.Join(objects, id)
+	if !fileExists(objectPath) {
+		if err := writeFileAtomic(objectPath, content); err != nil {
+			return err
+		}
+		if historyUsage.dir == objects {
+			historyUsage.bytes += int64(len(content))
+		}
+	}
+
+	history.Revisions = append(history.Revisions, &FileRevision{
+		ID:      id,
+		SavedAt: time.Now(),
+		Size:    int64(len(content)),
+		Source:  source,
+	})
+
+	maxRevisions := int(envInt64("FERMAT_HISTORY_MAX_REVISIONS", DEFAULT_HISTORY_MAX_REVISIONS))
+	if len(history.Revisions) > maxRevisions {
+		history.Revisions = history.Revisions[len(history.Revisions)-maxRevisions:]
+	}
+
+	if err := saveFileHistoryLocked(history); err != nil {
+		return err
+	}
+
+	return enforceHistoryBudgetLocked()
+}
+
+// snapshotBeforeWrite records what's on disk right before fermat overwrites it. That keeps the version
+// that existed before fermat ever touched the file, as well as changes made by other processes.
+func snapshotBeforeWrite(path string) {
+	recordFileFromDisk(path, HistoryDisk)
+}
+
+// recordFileFromDisk is recordFileRevision for writes that were streamed straight to disk.
+func recordFileFromDisk(path string, source HistorySource) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if info.Size() > envInt64("FERMAT_HISTORY_MAX_FILE_BYTES", DEFAULT_HISTORY_MAX_FILE_BYTES) {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	recordFileRevision(path, content, source)
+}
+
+// enforceHistoryBudgetLocked drops the oldest revisions across all files until the object store fits in
+// FERMAT_HISTORY_MAX_BYTES and then deletes objects nothing refers to anymore.
+func enforceHistoryBudgetLocked() error {
+	objects, err := historyDir("objects")
+	if err != nil {
+		return err
+	}
+
+	maxBytes := envInt64("FERMAT_HISTORY_MAX_BYTES", DEFAULT_HISTORY_MAX_BYTES)
+	if historyUsage.dir != objects {
+		historyUsage.dir = objects
+		historyUsage.bytes = diskUsage(objects)
+	}
+	if historyUsage.bytes <= maxBytes {
+		return nil
+	}
+	// Count from disk again next time if anything below fails halfway
+	historyUsage.dir = ""
+
+	files, err := historyDir("files")
+	if err != nil {
+		return err
+	}
+
+	histories := make([]*fileHistory, 0)
+	filepath.WalkDir(files, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var history fileHistory
+		if json.Unmarshal(data, &history) == nil {
+			histories = append(histories, &history)
+		}
+		return nil
+	})
+
+	revisions := make([]*FileRevision, 0)
+	for _, history := range histories {
+		revisions = append(revisions, history.Revisions...)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].SavedAt.Before(revisions[j].SavedAt) })
+
+	// Count every object once, then keep the newest revisions that fit in the budget.
+	sizes := make(map[string]int64)
+	for _, revision := range revisions {
+		sizes[revision.ID] = revision.Size
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	dropped := make(map[*FileRevision]bool)
+	live := make(map[string]int)
+	for _, revision := range revisions {
+		live[revision.ID]++
+	}
+	for _, revision := range revisions {
+		if total <= maxBytes {
+			break
+		}
+		dropped[revision] = true
+		live[revision.ID]--
+		if live[revision.ID] == 0 {
+			total -= sizes[revision.ID]
+		}
+	}
+
+	for _, history := range histories {
+		kept := history.Revisions[:0]
+		for _, revision := range history.Revisions {
+			if !dropped[revision] {
+				kept = append(kept, revision)
+			}
+		}
+		history.Revisions = kept
+		if err := saveFileHistoryLocked(history); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(objects)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if live[entry.Name()] == 0 {
+			os.Remove(filepath.Join(objects, entry.Name()))
+		}
+	}
+
+	historyUsage.dir = objects
+	historyUsage.bytes = total
+	return nil
+}
+
+func readRevisionContent(id string) ([]byte, error) {
+	if !historyIDRegex.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+
+	objects, err := historyDir("objects")
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(objects, id))
+}
+
+// listHistoryHandler returns the revisions of a file, newest first.
+func listHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	path, err := resolveWorkspacePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	historyLock.Lock()
+	history, err := loadFileHistoryLocked(path)
+	historyLock.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+
+	revisions := make([]*FileRevision, 0, len(history.Revisions))
+	for i := len(history.Revisions) - 1; i >= 0; i-- {
+		revisions = append(revisions, history.Revisions[i])
+	}
+
+	WriteJSONResponse(w, revisions)
+}
+
+// historyRevisionHandler returns the raw content of a revision.
+func historyRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	content, err := readRevisionContent(id)
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", contentETag(content))
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+type RestoreRevisionRequest struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+// restoreRevisionHandler writes a revision back to its file. The restore itself becomes a new revision so
+// it can be undone like any other save.
+func restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRevisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	path, err := resolveWorkspacePath(req.Path)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	// Only revisions from the file's own history can be restored, otherwise any file's content could be
+	// written anywhere just by knowing its hash.
+	historyLock.Lock()
+	history, err := loadFileHistoryLocked(path)
+	historyLock.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+
+	found := false
+	for _, revision := range history.Revisions {
+		if revision.ID == req.ID {
+			found = true
+			break
+		}
+	}
+
+	content, err := readRevisionContent(req.ID)
+	if !found || err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		current, err := fileETag(path)
+		if err != nil {
+			http.Error(w, "Failed to read current file", http.StatusInternalServerError)
+			return
+		}
+		if !etagMatches(ifMatch, current) {
+			writeFileConflict(w, path)
+			return
+		}
+	}
+
+	snapshotBeforeWrite(path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
+		return
+	}
+
+	if err := writeFileAtomic(path, content); err != nil {
+		http.Error(w, "Failed to write to file", http.StatusInternalServerError)
+		return
+	}
+	recordFileRevision(path, content, HistoryRestore)
+
+	etag := contentETag(content)
+	w.Header().Set("ETag", etag)
+	WriteJSONResponse(w, &FileVersionResponse{
+		ETag: etag,
+		Size: len(content),
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RecordFileRevision(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("FERMAT_HISTORY_MAX_REVISIONS", "3")
+
+	path := filepath.Join(t.TempDir(), "server.js")
+	for _, content := range []string{"one", "two", "two", "three", "four"} {
+		recordFileRevision(path, []byte(content), HistoryWrite)
+	}
+
+	history, err := loadFileHistoryLocked(path)
+	assert.Nil(t, err)
+	assert.Len(t, history.Revisions, 3)
+
+	oldest, err := readRevisionContent(history.Revisions[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "two", string(oldest))
+
+	newest, err := readRevisionContent(history.Revisions[2].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "four", string(newest))
+}
+
+func Test_HistoryBudget(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("FERMAT_HISTORY_MAX_BYTES", "10")
+
+	path := filepath.Join(t.TempDir(), "server.js")
+	for _, content := range []string{"1111", "2222", "3333", "4444"} {
+		recordFileRevision(path, []byte(content), HistoryWrite)
+	}
+
+	history, err := loadFileHistoryLocked(path)
+	assert.Nil(t, err)
+	assert.Len(t, history.Revisions, 2)
+	assert.Equal(t, int64(8), historyUsage.bytes)
+
+	oldest, err := readRevisionContent(history.Revisions[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "3333", string(oldest))
+}
+
+func Test_RestoreRevisionHandler(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	root := filepath.Join(home, "code")
+	assert.Nil(t, os.MkdirAll(root, 0755))
+
+	server, secrets := filepath.Join(root, "server.js"), filepath.Join(root, ".env")
+	recordFileRevision(server, []byte("console.log('one')"), HistoryWrite)
+	recordFileRevision(secrets, []byte("TOKEN=secret"), HistoryWrite)
+
+	serverHistory, err := loadFileHistoryLocked(server)
+	assert.Nil(t, err)
+	secretsHistory, err := loadFileHistoryLocked(secrets)
+	assert.Nil(t, err)
+
+	// A revision of another file can't be restored over server.js
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/code/history/restore", strings.NewReader(`{"path": "server.js", "id": "`+secretsHistory.Revisions[0].ID+`"}`))
+	restoreRevisionHandler(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.False(t, fileExists(server))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/code/history/restore", strings.NewReader(`{"path": "server.js", "id": "`+serverHistory.Revisions[0].ID+`"}`))
+	restoreRevisionHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	content, err := os.ReadFile(server)
+	assert.Nil(t, err)
+	assert.Equal(t, "console.log('one')", string(content))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_IGNORE_PATTERNS is used when FERMAT_IGNORE isn't set. It keeps the historical behavior of
+// never showing node_modules even if a project forgot to put it in its .gitignore.
+const DEFAULT_IGNORE_PATTERNS = "node_modules/"
+
+// How long a parsed .gitignore is trusted before we stat it again to look for changes.
+const gitignoreRecheckInterval = 2 * time.Second
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type gitignoreFile struct {
+	rules     []ignoreRule
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// ignoreMatcher answers whether a workspace path should be hidden from the file tree, watchers, search
+// and archives. Rules come from FERMAT_IGNORE (applied everywhere) and from every .gitignore between the
+// workspace root and the path, evaluated the same way git does: the last matching rule wins and nothing
+// inside an ignored directory can be un-ignored.
+type ignoreMatcher struct {
+	root  string
+	extra []ignoreRule
+
+	mu    sync.Mutex
+	cache map[string]*gitignoreFile
+}
+
+var (
+	workspaceIgnoreOnce sync.Once
+	workspaceIgnore     *ignoreMatcher
+	workspaceIgnoreErr  error
+)
+
+// getWorkspaceIgnore returns the shared ignore matcher rooted at the code workspace.
+func getWorkspaceIgnore() (*ignoreMatcher, error) {
+	workspaceIgnoreOnce.Do(func() {
+		root, err := workspaceRoot()
+		if err != nil {
+			workspaceIgnoreErr = err
+			return
+		}
+
+		patterns, ok := os.LookupEnv("FERMAT_IGNORE")
+		if !ok {
+			patterns = DEFAULT_IGNORE_PATTERNS
+		}
+		workspaceIgnore = newIgnoreMatcher(root, strings.Split(patterns, ","))
+	})
+	return workspaceIgnore, workspaceIgnoreErr
+}
+
+func newIgnoreMatcher(root string, patterns []string) *ignoreMatcher {
+	matcher := &ignoreMatcher{
+		root:  root,
+		cache: make(map[string]*gitignoreFile),
+	}
+	for _, pattern := range patterns {
+		if rule, ok := parseIgnoreRule(pattern); ok {
+			matcher.extra = append(matcher.extra, rule)
+		}
+	}
+	return matcher
+}
+
+// Match reports whether the absolute path is ignored. Paths outside of the root are never ignored.
+func (m *ignoreMatcher) Match(path string, isDir bool) bool {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		last := i == len(parts)-1
+		if m.matchOne(parts[:i+1], isDir || !last) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ignoreMatcher) matchOne(parts []string, isDir bool) bool {
+	name := parts[len(parts)-1]
+	if name == ".git" {
+		return true
+	}
+
+	ignored := false
+	apply := func(rules []ignoreRule, rel string) {
+		for _, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	apply(m.extra, strings.Join(parts, "/"))
+
+	// Walk the .gitignore files from the root down to the directory containing this entry. Each file's
+	// patterns are relative to the directory it lives in.
+	for depth := 0; depth < len(parts); depth++ {
+		dir := filepath.Join(append([]string{m.root}, parts[:depth]...)...)
+		apply(m.gitignoreRules(dir), strings.Join(parts[depth:], "/"))
+	}
+
+	return ignored
+}
+
+func (m *ignoreMatcher) gitignoreRules(dir string) []ignoreRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	cached, ok := m.cache[dir]
+	if ok && now.Sub(cached.checkedAt) < gitignoreRecheckInterval {
+		return cached.rules
+	}
+
+	path := filepath.Join(dir, ".gitignore")
+	info, err := os.Stat(path)
+	if err != nil {
+		m.cache[dir] = &gitignoreFile{checkedAt: now}
+		return nil
+	}
+
+	if ok && info.ModTime().Equal(cached.modTime) {
+		cached.checkedAt = now
+		return cached.rules
+	}
+
+	entry := &gitignoreFile{
+		rules:     readIgnoreFile(path),
+		modTime:   info.ModTime(),
+		checkedAt: now,
+	}
+	m.cache[dir] = entry
+	return entry.rules
+}
+
+func readIgnoreFile(path string) []ignoreRule {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// parseIgnoreRule converts a single gitignore line into a rule. Blank lines and comments return false.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// A slash anywhere but the end anchors the pattern to the .gitignore's directory, otherwise it can
+	// match an entry at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	expr := globToRegexp(line)
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+
+	pattern, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					expr.WriteString("(?:.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
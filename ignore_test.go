@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IgnoreMatcher(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "backend"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, ".gitignore"), []byte("# comment\n*.log\n/dist\nbuild/\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "backend", ".gitignore"), []byte("!keep.log\ncoverage/**\n"), 0644))
+
+	matcher := newIgnoreMatcher(root, []string{"node_modules/"})
+	join := func(parts ...string) string { return filepath.Join(append([]string{root}, parts...)...) }
+
+	assert.True(t, matcher.Match(join("frontend", "node_modules"), true))
+	assert.True(t, matcher.Match(join("frontend", "node_modules", "react", "index.js"), false))
+	assert.True(t, matcher.Match(join("backend", "server.log"), false))
+	assert.False(t, matcher.Match(join("backend", "keep.log"), false))
+	assert.True(t, matcher.Match(join("dist"), true))
+	assert.False(t, matcher.Match(join("backend", "dist"), true))
+	assert.True(t, matcher.Match(join("frontend", "build"), true))
+	assert.False(t, matcher.Match(join("frontend", "build"), false))
+	assert.True(t, matcher.Match(join("backend", "coverage", "lcov", "index.html"), false))
+	assert.True(t, matcher.Match(join(".git", "HEAD"), false))
+	assert.False(t, matcher.Match(join("backend", "server.js"), false))
+}
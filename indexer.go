@@ -1,92 +1,664 @@
 package main
 
 import (
-	"fmt"
-	"github.com/blevesearch/bleve"
-	"github.com/fsnotify/fsnotify"
-	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// INDEX_MAPPING_VERSION must be bumped whenever newCodeIndexMapping changes. An index built with a
+// different version is thrown away and rebuilt on startup.
+const INDEX_MAPPING_VERSION = "2"
+
+// Files bigger than this (FERMAT_INDEX_MAX_FILE_BYTES) are almost never hand written code, so they're
+// left out of the index along with anything binary.
+const DEFAULT_INDEX_MAX_FILE_BYTES = 1 << 20
+
+var (
+	indexMappingVersionKey = []byte("mapping_version")
+	errRebuildRequested    = errors.New("rebuild requested")
+)
+
+// codeDocument is what gets stored in the index for every file in the workspace.
+type codeDocument struct {
+	// Path is slash separated and relative to the workspace so it can be prefix matched by directory
+	Path    string `json:"path"`
+	Ext     string `json:"ext"`
+	Content string `json:"content"`
+}
+
+// indexedFileMeta is kept in the index's internal storage (keyed by "meta:" + path) so a restart can
+// tell which files changed while fermat wasn't running without re-reading everything.
+type indexedFileMeta struct {
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+	Hash    string `json:"hash"`
+}
+
+type IndexState string
+
+const (
+	IndexStarting   IndexState = "starting"
+	IndexScanning   IndexState = "scanning"
+	IndexReady      IndexState = "ready"
+	IndexRebuilding IndexState = "rebuilding"
+	IndexFailed     IndexState = "failed"
 )
 
-func indexFile(filePath string, index bleve.Index) {
-	content, err := ioutil.ReadFile(filePath)
+type IndexStatus struct {
+	State      IndexState `json:"state"`
+	Scanned    int        `json:"scanned"`
+	Indexed    int        `json:"indexed"`
+	Skipped    int        `json:"skipped"`
+	Removed    int        `json:"removed"`
+	DocCount   uint64     `json:"docCount"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+type codeIndexer struct {
+	root   string
+	index  bleve.Index
+	ignore *ignoreMatcher
+}
+
+var (
+	codeIndexMu sync.RWMutex
+	// codeIndex is nil while the indexer is starting up. Readers hold the read lock for as long as they
+	// use it since the index is closed under the write lock when the indexer stops.
+	codeIndex *codeIndexer
+
+	indexStatusMu sync.Mutex
+	indexStatus   = IndexStatus{State: IndexStarting}
+
+	rebuildRequests = make(chan struct{}, 1)
+)
+
+func updateIndexStatus(update func(status *IndexStatus)) {
+	indexStatusMu.Lock()
+	defer indexStatusMu.Unlock()
+	update(&indexStatus)
+}
+
+func newCodeIndexMapping() mapping.IndexMapping {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+
+	contentField := bleve.NewTextFieldMapping()
+	contentField.Store = true
+	contentField.IncludeTermVectors = true
+
+	document := bleve.NewDocumentMapping()
+	document.AddFieldMappingsAt("path", keywordField)
+	document.AddFieldMappingsAt("ext", keywordField)
+	document.AddFieldMappingsAt("content", contentField)
+
+	indexMapping := bleve.NewIndexMapping()
+	indexMapping.DefaultMapping = document
+	return indexMapping
+}
+
+// indexPath is where the search index lives, $HOME/.fermat/index. bleve insists on creating that
+// directory itself so only its parent is created here.
+func indexPath() (string, error) {
+	dir, err := fermatStateDir()
 	if err != nil {
-		fmt.Printf("Error reading %s: %v\n", filePath, err)
-		return
+		return "", err
 	}
-	index.Index(filePath, string(content))
+	return filepath.Join(dir, "index"), nil
 }
 
-func recursiveIndex(dir string, index bleve.Index) {
-	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+// openOrCreateIndex reuses the index from a previous run when it's compatible and starts from scratch
+// when it's missing, corrupt or was built with an older mapping.
+func openOrCreateIndex() (bleve.Index, error) {
+	path, err := indexPath()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := bleve.Open(path)
+	if err == nil {
+		version, verr := index.GetInternal(indexMappingVersionKey)
+		if verr == nil && string(version) == INDEX_MAPPING_VERSION {
+			return index, nil
+		}
+		log.Println("[Info] Search index was built with an older mapping, rebuilding it.")
+		index.Close()
+	} else if err != bleve.ErrorIndexPathDoesNotExist {
+		log.Printf("[Warn] Couldn't open search index, rebuilding it: %v", err)
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+
+	index, err = bleve.New(path, newCodeIndexMapping())
+	if err != nil {
+		return nil, err
+	}
+	if err := index.SetInternal(indexMappingVersionKey, []byte(INDEX_MAPPING_VERSION)); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// CodeIndexerServiceRunner keeps the full-text index of the workspace up to date for /code/search. If
+// the indexer ever dies it's restarted with an exponential backoff capped at 5 minutes.
+func CodeIndexerServiceRunner() {
+	log.Println("Starting the CodeIndexerServiceRunner...")
+
+	currentDelay := 1
+	for {
+		err := runCodeIndexer()
+		if err == errRebuildRequested {
+			log.Println("[Info] Rebuilding the search index...")
+			if path, err := indexPath(); err != nil {
+				log.Printf("[Error] Failed to locate search index: %v", err)
+			} else if err := os.RemoveAll(path); err != nil {
+				log.Printf("[Error] Failed to remove search index: %v", err)
+			}
+			currentDelay = 1
+			continue
+		}
+
+		updateIndexStatus(func(status *IndexStatus) {
+			status.State = IndexFailed
+			status.LastError = err.Error()
+		})
+		log.Printf("[Error] Code indexer stopped: %v. Restarting in %d seconds.", err, currentDelay)
+		time.Sleep(time.Duration(currentDelay) * time.Second)
+
+		currentDelay = int(math.Min(300, float64(currentDelay)*2))
+	}
+}
+
+func runCodeIndexer() error {
+	root, err := workspaceRoot()
+	if err != nil {
+		return err
+	}
+
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := getWorkspaceWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Subscribe before the initial scan so changes made while scanning aren't lost.
+	events, unsubscribe := watcher.Subscribe()
+	defer unsubscribe()
+
+	index, err := openOrCreateIndex()
+	if err != nil {
+		return err
+	}
+
+	indexer := &codeIndexer{root: root, index: index, ignore: ignore}
+
+	// Searching the previous run's index is better than nothing while we catch up.
+	codeIndexMu.Lock()
+	codeIndex = indexer
+	codeIndexMu.Unlock()
+	defer func() {
+		codeIndexMu.Lock()
+		codeIndex = nil
+		index.Close()
+		codeIndexMu.Unlock()
+	}()
+
+	indexer.reconcile()
+	log.Println("Initial indexing complete.")
+
+	for {
+		select {
+		case batch := <-events:
+			for _, event := range batch {
+				indexer.handleEvent(event)
+			}
+		case <-rebuildRequests:
+			return errRebuildRequested
+		}
+	}
+}
+
+func metaKey(path string) []byte {
+	return []byte("meta:" + path)
+}
+
+// reconcile brings the index in line with what's on disk: new and changed files are (re)indexed and
+// documents for files that were deleted or are now ignored are dropped. A file only gets read when its
+// mtime or size changed, and only gets re-indexed when its content hash changed.
+func (indexer *codeIndexer) reconcile() {
+	updateIndexStatus(func(status *IndexStatus) {
+		if status.State != IndexRebuilding {
+			status.State = IndexScanning
+		}
+		status.Scanned, status.Indexed, status.Skipped, status.Removed = 0, 0, 0, 0
+		status.StartedAt = time.Now()
+		status.FinishedAt = nil
+		status.LastError = ""
+	})
+
+	seen := make(map[string]bool)
+	batch := indexer.index.NewBatch()
+	flush := func() {
+		if batch.Size() == 0 {
+			return
+		}
+		if err := indexer.index.Batch(batch); err != nil {
+			log.Printf("Error writing to the search index: %v", err)
+		}
+		batch.Reset()
+	}
+
+	filepath.WalkDir(indexer.root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return err
+			return nil
+		}
+		if path != indexer.root && indexer.ignore.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if !info.IsDir() {
-			indexFile(path, index)
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		updateIndexStatus(func(status *IndexStatus) { status.Scanned++ })
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		var meta indexedFileMeta
+		if data, err := indexer.index.GetInternal(metaKey(path)); err == nil && data != nil {
+			json.Unmarshal(data, &meta)
+			if meta.ModTime == info.ModTime().UnixNano() && meta.Size == info.Size() {
+				seen[path] = true
+				return nil
+			}
+		}
+
+		indexed := indexer.prepareFile(batch, path, info, meta.Hash)
+		if indexed {
+			seen[path] = true
+		}
+
+		if batch.Size() >= 100 {
+			flush()
 		}
 		return nil
 	})
+	flush()
+
+	// Anything left in the index that we didn't come across no longer exists or is ignored now.
+	removed := 0
+	for from := 0; ; from += 1000 {
+		result, err := indexer.index.Search(bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 1000, from, false))
+		if err != nil || len(result.Hits) == 0 {
+			break
+		}
+		for _, hit := range result.Hits {
+			if !seen[hit.ID] {
+				batch.Delete(hit.ID)
+				batch.DeleteInternal(metaKey(hit.ID))
+				removed++
+			}
+		}
+	}
+	flush()
+
+	docCount, _ := indexer.index.DocCount()
+	updateIndexStatus(func(status *IndexStatus) {
+		now := time.Now()
+		status.State = IndexReady
+		status.Removed = removed
+		status.DocCount = docCount
+		status.FinishedAt = &now
+	})
 }
 
-func fileIndexerWatcher() {
-	// Create or open index
-	mapping := bleve.NewIndexMapping()
-	index, err := bleve.New("fermat_swizzle.bleve", mapping)
-	if err != nil {
-		fmt.Println(err)
-		return
+// prepareFile adds whatever is needed to bring path up to date to the batch. It returns false when the
+// file shouldn't be in the index at all (binary, too big or unreadable), in which case any existing
+// document is removed. previousHash lets unchanged content skip re-indexing after a touch.
+func (indexer *codeIndexer) prepareFile(batch *bleve.Batch, path string, info fs.FileInfo, previousHash string) bool {
+	skip := func() bool {
+		batch.Delete(path)
+		batch.DeleteInternal(metaKey(path))
+		updateIndexStatus(func(status *IndexStatus) { status.Skipped++ })
+		return false
+	}
+
+	if info.Size() > envInt64("FERMAT_INDEX_MAX_FILE_BYTES", DEFAULT_INDEX_MAX_FILE_BYTES) {
+		return skip()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || isBinaryContent(content) {
+		return skip()
+	}
+
+	sum := sha256.Sum256(content)
+	meta, _ := json.Marshal(&indexedFileMeta{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Hash:    hex.EncodeToString(sum[:]),
+	})
+	batch.SetInternal(metaKey(path), meta)
+
+	if hex.EncodeToString(sum[:]) == previousHash {
+		return true
 	}
-	defer index.Close()
 
-	// Initial indexing
-	recursiveIndex(".", index)
-	fmt.Println("Initial indexing complete.")
+	rel, err := filepath.Rel(indexer.root, path)
+	if err != nil {
+		return skip()
+	}
 
-	// Set up file watcher
-	watcher, err := fsnotify.NewWatcher()
+	err = batch.Index(path, &codeDocument{
+		Path:    filepath.ToSlash(rel),
+		Ext:     strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")),
+		Content: string(content),
+	})
 	if err != nil {
-		fmt.Println("Error creating watcher:", err)
+		log.Printf("Error indexing %s: %v", path, err)
+		return skip()
+	}
+
+	updateIndexStatus(func(status *IndexStatus) { status.Indexed++ })
+	return true
+}
+
+func (indexer *codeIndexer) handleEvent(event FileEvent) {
+	switch event.Op {
+	case FileCreated, FileWritten:
+		if event.IsDir {
+			indexer.recursiveIndex(event.Path)
+		} else {
+			indexer.indexFile(event.Path)
+		}
+	case FileRemoved, FileRenamed:
+		if event.IsDir {
+			indexer.deleteDir(event.Path)
+		} else {
+			indexer.index.Delete(event.Path)
+			indexer.index.DeleteInternal(metaKey(event.Path))
+		}
+	case FileResync:
+		indexer.reconcile()
+	}
+}
+
+func (indexer *codeIndexer) indexFile(filePath string) {
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
 		return
 	}
-	defer watcher.Close()
 
-	// Recursively add directories to the watcher
-	filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+	batch := indexer.index.NewBatch()
+	indexer.prepareFile(batch, filePath, info, "")
+	if err := indexer.index.Batch(batch); err != nil {
+		log.Printf("Error indexing %s: %v", filePath, err)
+	}
+}
+
+func (indexer *codeIndexer) recursiveIndex(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return err
+			return nil
+		}
+		if indexer.ignore.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if info.IsDir() {
-			watcher.Add(path)
+		if d.Type().IsRegular() {
+			indexer.indexFile(path)
 		}
 		return nil
 	})
+}
+
+// deleteDir removes every document underneath a directory that was removed or renamed away.
+func (indexer *codeIndexer) deleteDir(dir string) {
+	rel, err := filepath.Rel(indexer.root, dir)
+	if err != nil {
+		return
+	}
+
+	prefix := bleve.NewPrefixQuery(filepath.ToSlash(rel) + "/")
+	prefix.SetField("path")
 
-	// Process events
 	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
+		result, err := indexer.index.Search(bleve.NewSearchRequestOptions(prefix, 500, 0, false))
+		if err != nil || len(result.Hits) == 0 {
+			return
+		}
+
+		batch := indexer.index.NewBatch()
+		for _, hit := range result.Hits {
+			batch.Delete(hit.ID)
+			batch.DeleteInternal(metaKey(hit.ID))
+		}
+		if err := indexer.index.Batch(batch); err != nil {
+			log.Printf("Error removing %s from the index: %v", dir, err)
+			return
+		}
+	}
+}
+
+func searchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	indexStatusMu.Lock()
+	status := indexStatus
+	indexStatusMu.Unlock()
+
+	codeIndexMu.RLock()
+	if codeIndex != nil {
+		status.DocCount, _ = codeIndex.index.DocCount()
+	}
+	codeIndexMu.RUnlock()
+
+	WriteJSONResponse(w, &status)
+}
+
+// searchRebuildHandler throws the index away and builds it again from scratch in the background.
+func searchRebuildHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case rebuildRequests <- struct{}{}:
+		updateIndexStatus(func(status *IndexStatus) { status.State = IndexRebuilding })
+		WriteJSONResponseWithHeader(w, http.StatusAccepted, map[string]string{"status": "rebuild started"})
+	default:
+		http.Error(w, "A rebuild is already pending", http.StatusConflict)
+	}
+}
+
+type SearchMatch struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type SearchResult struct {
+	Path      string        `json:"path"`
+	Score     float64       `json:"score"`
+	Fragments []string      `json:"fragments"`
+	Matches   []SearchMatch `json:"matches"`
+}
+
+type SearchResponse struct {
+	Total   uint64          `json:"total"`
+	From    int             `json:"from"`
+	Size    int             `json:"size"`
+	Took    time.Duration   `json:"took"`
+	Results []*SearchResult `json:"results"`
+}
+
+// The most matching lines reported for a single file
+const maxSearchMatchesPerFile = 20
+
+// searchHandler runs a full-text query against the index. Results can be narrowed down to a directory
+// with path and to file extensions with ext (comma separated), and are paginated with from and size.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	text := queryParams.Get("q")
+	if text == "" {
+		http.Error(w, "Param q can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	from, size := 0, 20
+	for name, target := range map[string]*int{"from": &from, "size": &size} {
+		if value := queryParams.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, "Param "+name+" must be a non-negative integer", http.StatusBadRequest)
 				return
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				fmt.Println("Modified file:", event.Name)
-				indexFile(event.Name, index)
-			}
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				fmt.Println("Removed file:", event.Name)
-				index.Delete(event.Name)
+			*target = parsed
+		}
+	}
+	if size > 100 {
+		size = 100
+	}
+
+	match := bleve.NewMatchQuery(text)
+	match.SetField("content")
+	conjuncts := []query.Query{match}
+
+	if dir := queryParams.Get("path"); dir != "" {
+		_, rel, err := relWorkspacePath(dir)
+		if err != nil {
+			writeWorkspacePathError(w, err)
+			return
+		}
+		if rel != "" {
+			prefix := bleve.NewPrefixQuery(rel + "/")
+			prefix.SetField("path")
+			conjuncts = append(conjuncts, prefix)
+		}
+	}
+
+	if exts := queryParams.Get("ext"); exts != "" {
+		disjuncts := make([]query.Query, 0)
+		for _, ext := range strings.Split(exts, ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext == "" {
+				continue
 			}
-			if event.Op&fsnotify.Rename == fsnotify.Rename {
-				fmt.Println("Renamed file:", event.Name)
-				index.Delete(event.Name)
+			term := bleve.NewTermQuery(ext)
+			term.SetField("ext")
+			disjuncts = append(disjuncts, term)
+		}
+		if len(disjuncts) > 0 {
+			conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(disjuncts...))
+		}
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(conjuncts...), size, from, false)
+	req.Highlight = bleve.NewHighlightWithStyle("html")
+	req.Highlight.AddField("content")
+	req.IncludeLocations = true
+	req.Fields = []string{"content"}
+
+	codeIndexMu.RLock()
+	if codeIndex == nil {
+		codeIndexMu.RUnlock()
+		http.Error(w, "Search index isn't ready yet", http.StatusServiceUnavailable)
+		return
+	}
+	result, err := codeIndex.index.Search(req)
+	codeIndexMu.RUnlock()
+	if err != nil {
+		http.Error(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := &SearchResponse{
+		Total:   result.Total,
+		From:    from,
+		Size:    size,
+		Took:    result.Took,
+		Results: make([]*SearchResult, 0, len(result.Hits)),
+	}
+
+	for _, hit := range result.Hits {
+		content, _ := hit.Fields["content"].(string)
+
+		offsets := make([]int, 0)
+		for _, locations := range hit.Locations["content"] {
+			for _, location := range locations {
+				offsets = append(offsets, int(location.Start))
 			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
+		}
+
+		response.Results = append(response.Results, &SearchResult{
+			Path:      hit.ID,
+			Score:     hit.Score,
+			Fragments: hit.Fragments["content"],
+			Matches:   matchingLines(content, offsets, maxSearchMatchesPerFile),
+		})
+	}
+
+	WriteJSONResponse(w, response)
+}
+
+// matchingLines turns byte offsets into the distinct 1-based lines they fall on, in order.
+func matchingLines(content string, offsets []int, limit int) []SearchMatch {
+	sort.Ints(offsets)
+
+	matches := make([]SearchMatch, 0)
+	line, lineStart, pos := 1, 0, 0
+	for _, offset := range offsets {
+		if offset > len(content) {
+			break
+		}
+		for ; pos < offset; pos++ {
+			if content[pos] == '\n' {
+				line++
+				lineStart = pos + 1
 			}
-			fmt.Println("Error:", err)
 		}
+		if len(matches) > 0 && matches[len(matches)-1].Line == line {
+			continue
+		}
+		if len(matches) == limit {
+			break
+		}
+
+		lineEnd := strings.IndexByte(content[lineStart:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(content) - lineStart
+		}
+		text := content[lineStart : lineStart+lineEnd]
+		if len(text) > 200 {
+			text = text[:200]
+		}
+		matches = append(matches, SearchMatch{Line: line, Text: strings.TrimRight(text, "\r")})
 	}
+	return matches
 }
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Finished jobs are kept in memory so clients can still read how they ended, the deployment ledger is
+	// the permanent record.
+	maxFinishedJobs = 50
+	// Command output kept per job, the oldest goes first. Subscribers still get all of it as it happens.
+	maxJobOutputBytes = 256 << 10
+)
+
+type JobKind string
+
+const (
+	JobPushProduction     JobKind = "push_to_production"
+	JobRollbackProduction JobKind = "rollback_production"
+)
+
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+type JobEventType string
+
+const (
+	JobEventPhase  JobEventType = "phase"
+	JobEventOutput JobEventType = "output"
+	JobEventDone   JobEventType = "done"
+)
+
+type JobEvent struct {
+	Seq    int                     `json:"seq"`
+	Time   time.Time               `json:"time"`
+	Type   JobEventType            `json:"type"`
+	Phase  string                  `json:"phase,omitempty"`
+	Text   string                  `json:"text,omitempty"`
+	Result *PushProductionResponse `json:"result,omitempty"`
+}
+
+// Job is a long running operation started by a request that returns before it's done. Its progress is
+// a list of events: phase transitions, command output and finally the result.
+type Job struct {
+	ID         string                  `json:"id"`
+	Kind       JobKind                 `json:"kind"`
+	State      JobState                `json:"state"`
+	Phase      string                  `json:"phase"`
+	CreatedAt  time.Time               `json:"createdAt"`
+	FinishedAt *time.Time              `json:"finishedAt,omitempty"`
+	Result     *PushProductionResponse `json:"result,omitempty"`
+	Events     []*JobEvent             `json:"events"`
+	// OutputTruncated is set once output events were dropped to stay within maxJobOutputBytes
+	OutputTruncated bool `json:"outputTruncated,omitempty"`
+
+	mu          sync.Mutex
+	subscribers map[chan *JobEvent]struct{}
+	seq         int
+	outputBytes int
+}
+
+type JobStartedResponse struct {
+	ID   string  `json:"id"`
+	Kind JobKind `json:"kind"`
+}
+
+type JobInProgressResponse struct {
+	Message string `json:"message"`
+	ID      string `json:"id"`
+}
+
+var (
+	// jobsLock guards jobs and activeDeploy
+	jobsLock sync.Mutex
+	jobs     = make(map[string]*Job)
+	// activeDeploy is the deploy that's running, only one runs at a time
+	activeDeploy *Job
+)
+
+// startDeployJob registers a new deploy job, unless one is already running in which case that one is
+// returned instead.
+func startDeployJob(kind JobKind) (*Job, *Job) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	if activeDeploy != nil {
+		return nil, activeDeploy
+	}
+
+	idBytes := make([]byte, 12)
+	rand.Read(idBytes)
+
+	job := &Job{
+		ID:          hex.EncodeToString(idBytes),
+		Kind:        kind,
+		State:       JobRunning,
+		CreatedAt:   time.Now(),
+		Events:      make([]*JobEvent, 0),
+		subscribers: make(map[chan *JobEvent]struct{}),
+	}
+	jobs[job.ID] = job
+	activeDeploy = job
+	return job, nil
+}
+
+// runJob runs fn in the background and finishes job with its result. A panic fails the job rather than
+// taking the server down, or leaving the deploy slot taken forever.
+func runJob(job *Job, fn func() *PushProductionResponse) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[Error] Job %s crashed: %v\n%s", job.ID, r, debug.Stack())
+				job.Finish(&PushProductionResponse{
+					Status:  Failed,
+					Message: fmt.Sprintf("The job crashed: %v", r),
+				})
+			}
+		}()
+
+		job.Finish(fn())
+	}()
+}
+
+func getJob(id string) *Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	return jobs[id]
+}
+
+// pruneJobsLocked forgets the oldest finished jobs beyond maxFinishedJobs.
+func pruneJobsLocked() {
+	finished := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job != activeDeploy {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(jobs, job.ID)
+	}
+}
+
+func (job *Job) publishLocked(event *JobEvent) {
+	job.seq++
+	event.Seq = job.seq
+	event.Time = time.Now()
+	job.Events = append(job.Events, event)
+	if event.Type == JobEventOutput {
+		job.outputBytes += len(event.Text)
+		// Trimming copies the events, doing it only every so often keeps that cheap
+		if job.outputBytes > maxJobOutputBytes+maxJobOutputBytes/4 {
+			job.trimOutputLocked()
+		}
+	}
+
+	for ch := range job.subscribers {
+		select {
+		case ch <- event:
+		default:
+			if event.Type != JobEventDone {
+				log.Printf("[Warn] Subscriber of job %s is falling behind, dropped event %d", job.ID, event.Seq)
+				continue
+			}
+			// The result has to get through before Finish closes the channel, so the subscriber loses its
+			// oldest pending event instead. Only publishers send and they hold job.mu, so there's room now.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+	}
+}
+
+// trimOutputLocked drops the oldest output until what's left fits in maxJobOutputBytes. Phase changes and
+// the result are always kept.
+func (job *Job) trimOutputLocked() {
+	kept := make([]*JobEvent, 0, len(job.Events))
+	for _, event := range job.Events {
+		if event.Type == JobEventOutput && job.outputBytes > maxJobOutputBytes {
+			excess := job.outputBytes - maxJobOutputBytes
+			if excess < len(event.Text) {
+				// Keep the end of an event that's only partly over, events may be shared with subscribers
+				// so it's a copy
+				trimmed := *event
+				trimmed.Text = event.Text[excess:]
+				job.outputBytes -= excess
+				job.OutputTruncated = true
+				kept = append(kept, &trimmed)
+				continue
+			}
+			job.outputBytes -= len(event.Text)
+			job.OutputTruncated = true
+			continue
+		}
+		kept = append(kept, event)
+	}
+	job.Events = kept
+}
+
+func (job *Job) SetPhase(phase string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.Phase = phase
+	job.publishLocked(&JobEvent{Type: JobEventPhase, Phase: phase})
+}
+
+// Write makes a job usable as the output stream of a CommandRunner.
+func (job *Job) Write(p []byte) (int, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.publishLocked(&JobEvent{Type: JobEventOutput, Phase: job.Phase, Text: string(p)})
+	return len(p), nil
+}
+
+// Finish records the result and frees the deploy slot. Subscribers get the final event and their channel
+// closed. Only the first call counts.
+func (job *Job) Finish(result *PushProductionResponse) {
+	job.mu.Lock()
+	if job.FinishedAt != nil {
+		job.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Result = result
+	job.State = JobSucceeded
+	if result.Status == Failed || result.Status == ChecksFailed {
+		job.State = JobFailed
+	}
+	job.publishLocked(&JobEvent{Type: JobEventDone, Phase: job.Phase, Result: result})
+	for ch := range job.subscribers {
+		close(ch)
+	}
+	job.subscribers = make(map[chan *JobEvent]struct{})
+	job.mu.Unlock()
+
+	jobsLock.Lock()
+	if activeDeploy == job {
+		activeDeploy = nil
+	}
+	pruneJobsLocked()
+	jobsLock.Unlock()
+}
+
+// Subscribe returns the events so far and a channel with the ones still to come, which is closed when the
+// job finishes (right away if it already has).
+func (job *Job) Subscribe() ([]*JobEvent, <-chan *JobEvent, func()) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	past := make([]*JobEvent, len(job.Events))
+	copy(past, job.Events)
+
+	ch := make(chan *JobEvent, 1024)
+	if job.FinishedAt != nil {
+		close(ch)
+		return past, ch, func() {}
+	}
+	job.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	return past, ch, func() {
+		once.Do(func() {
+			job.mu.Lock()
+			delete(job.subscribers, ch)
+			job.mu.Unlock()
+		})
+	}
+}
+
+// snapshot copies the job so it can be serialized without holding its lock.
+func (job *Job) snapshot() *Job {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	return &Job{
+		ID:         job.ID,
+		Kind:       job.Kind,
+		State:      job.State,
+		Phase:      job.Phase,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+		Result:     job.Result,
+		Events:     append([]*JobEvent{}, job.Events...),
+
+		OutputTruncated: job.OutputTruncated,
+	}
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	job := getJob(chi.URLParam(r, "id"))
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	WriteJSONResponse(w, job.snapshot())
+}
+
+// jobStreamHandler sends every event of a job over a websocket, starting with the ones that already
+// happened, and closes the connection once the job is done.
+func jobStreamHandler(w http.ResponseWriter, r *http.Request) {
+	job := getJob(chi.URLParam(r, "id"))
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade websocket connection", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	past, events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	for _, event := range past {
+		if err := conn.WriteJSON(event); err != nil {
+			log.Println("Error writing to websocket connection", err)
+			return
+		}
+	}
+
+	closeReceived := make(chan struct{})
+	go func() {
+		defer close(closeReceived)
+
+		for {
+			messageType, _, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if messageType == websocket.CloseMessage {
+				break
+			}
+		}
+	}()
+
+	clientClosed := r.Context().Done()
+
+	// Ping every 60 seconds checking for dead connection
+	pinger := time.NewTicker(60 * time.Second)
+	defer pinger.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "job finished"))
+				if err != nil {
+					log.Println("Error writing to websocket connection", err)
+				}
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				log.Println("Error writing to websocket connection", err)
+				return
+			}
+		case <-clientClosed:
+			return
+		case <-pinger.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closeReceived:
+			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			if err != nil {
+				log.Println("Error writing to websocket connection", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// activeDeployJob returns the deploy job holding the deploy slot, if any.
+func activeDeployJob() *Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	return activeDeploy
+}
+
+func Test_DeployJobs(t *testing.T) {
+	job, running := startDeployJob(JobPushProduction)
+	assert.Nil(t, running)
+	assert.NotNil(t, job)
+
+	_, running = startDeployJob(JobPushProduction)
+	assert.Equal(t, job, running)
+
+	job.SetPhase("pushing")
+	job.Write([]byte("Everything up-to-date\n"))
+
+	past, events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+	assert.Equal(t, 2, len(past))
+	assert.Equal(t, JobEventOutput, past[1].Type)
+	assert.Equal(t, "pushing", past[1].Phase)
+
+	job.Finish(&PushProductionResponse{Status: NoChanges})
+	done := <-events
+	assert.Equal(t, JobEventDone, done.Type)
+	assert.Equal(t, 3, done.Seq)
+	_, open := <-events
+	assert.False(t, open)
+
+	assert.Equal(t, JobSucceeded, getJob(job.ID).State)
+	assert.Nil(t, activeDeployJob())
+}
+
+func Test_RunJobRecovers(t *testing.T) {
+	job, running := startDeployJob(JobPushProduction)
+	assert.Nil(t, running)
+
+	_, events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	runJob(job, func() *PushProductionResponse {
+		panic("boom")
+	})
+	done := <-events
+	assert.Equal(t, JobEventDone, done.Type)
+	assert.Equal(t, Failed, done.Result.Status)
+	assert.Equal(t, "The job crashed: boom", done.Result.Message)
+	assert.Nil(t, activeDeployJob())
+
+	// Finishing again changes nothing
+	job.Finish(&PushProductionResponse{Status: BuildTriggered})
+	assert.Equal(t, JobFailed, getJob(job.ID).State)
+}
+
+func Test_JobDoneReachesSlowSubscribers(t *testing.T) {
+	job, running := startDeployJob(JobPushProduction)
+	assert.Nil(t, running)
+
+	_, events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	// Nobody reads until the job is over, which fills the subscriber's buffer
+	for i := 0; i < 2*cap(events); i++ {
+		job.Write([]byte("line\n"))
+	}
+	job.Finish(&PushProductionResponse{Status: NoChanges})
+
+	var last *JobEvent
+	for event := range events {
+		last = event
+	}
+	assert.Equal(t, JobEventDone, last.Type)
+	assert.Equal(t, NoChanges, last.Result.Status)
+}
+
+func Test_JobOutputIsCapped(t *testing.T) {
+	job, running := startDeployJob(JobPushProduction)
+	assert.Nil(t, running)
+	defer job.Finish(&PushProductionResponse{Status: NoChanges})
+
+	job.SetPhase("checking")
+	chunk := []byte(strings.Repeat("x", 1023) + "\n")
+	writes := 2 * maxJobOutputBytes / len(chunk)
+	for i := 0; i < writes; i++ {
+		job.Write(chunk)
+	}
+
+	snapshot := job.snapshot()
+	assert.True(t, snapshot.OutputTruncated)
+	assert.Equal(t, JobEventPhase, snapshot.Events[0].Type)
+
+	stored := 0
+	for _, event := range snapshot.Events[1:] {
+		stored += len(event.Text)
+	}
+	assert.LessOrEqual(t, stored, maxJobOutputBytes+maxJobOutputBytes/4)
+	assert.GreaterOrEqual(t, stored, maxJobOutputBytes)
+	// Sequence numbers keep counting, clients can tell output is missing
+	assert.Equal(t, writes+1, snapshot.Events[len(snapshot.Events)-1].Seq)
+}
@@ -93,6 +93,9 @@ func main() {
 	// Start Health Service Runner
 	go HealthStatusServiceRunner()
 
+	// Start the code search indexer
+	go CodeIndexerServiceRunner()
+
 	// Prune old docker images. It's important that this is run AFTER the health service gets started so that
 	// we can report up and running without having to wait on this command completing.
 	if err = runDockerSystemPrune(); err != nil {
@@ -132,13 +135,45 @@ func setupHTTPServer(shutdownChan chan bool) error {
 	r.HandleFunc("/code/frontend/package.json", packageJSONReact)
 	r.HandleFunc("/code", getFileList)
 	r.HandleFunc("/code/delete", deleteFile)
+	r.Get("/code/trash", listTrashHandler)
+	r.Post("/code/trash/{id}/restore", restoreTrashHandler)
+	r.Delete("/code/trash/{id}", purgeTrashHandler)
+	r.Delete("/code/trash", purgeTrashHandler)
+	r.Post("/code/move", moveFile)
+	r.Get("/code/watch", watchFilesHandler)
+	r.Get("/code/search", searchHandler)
+	r.Get("/code/search/status", searchStatusHandler)
+	r.Post("/code/search/rebuild", searchRebuildHandler)
+	r.Get("/code/grep", grepHandler)
+	r.Delete("/code/grep/{token}", cancelGrepHandler)
+	r.Get("/code/find_files", findFilesHandler)
+	r.Get("/code/symbols", symbolsHandler)
+	r.Get("/code/definition", definitionHandler)
+	r.Get("/code/references", referencesHandler)
+	r.Post("/code/replace/preview", replacePreviewHandler)
+	r.Post("/code/replace/apply", replaceApplyHandler)
 
 	//Get file contents
 	r.HandleFunc("/code/file_contents", fileContents)
 	//Write file contents
 	r.HandleFunc("/code/write_file", writeCodeFile)
+	r.Post("/code/patch", patchFile)
+
+	// Local history of every save
+	r.Get("/code/history", listHistoryHandler)
+	r.Get("/code/history/revision", historyRevisionHandler)
+	r.Post("/code/history/restore", restoreRevisionHandler)
 	// For arbitrary file content such as videos or images
 	r.Post("/code/upload", writeAnyFile)
+	// Resumable, chunked uploads for anything too big for a single multipart request
+	r.Post("/code/upload/sessions", createUploadSessionHandler)
+	r.Get("/code/upload/sessions/{id}", getUploadSessionHandler)
+	r.Put("/code/upload/sessions/{id}", uploadChunkHandler)
+	r.Post("/code/upload/sessions/{id}/complete", completeUploadHandler)
+	r.Delete("/code/upload/sessions/{id}", abortUploadHandler)
+
+	r.Get("/code/archive", exportArchiveHandler)
+	r.Post("/code/archive/import", importArchiveHandler)
 
 	r.Get("/spoof_jwt", spoofJwt)
 	r.Get("/version", func(w http.ResponseWriter, r *http.Request) {
@@ -147,7 +182,23 @@ func setupHTTPServer(shutdownChan chan bool) error {
 	})
 
 	r.HandleFunc("/commit", commitHandler)
+	r.Get("/git/status", gitStatusHandler)
+	r.Get("/git/diff", gitDiffHandler)
+	r.Get("/git/log", gitLogHandler)
+	r.Get("/git/show", gitShowHandler)
+	r.Get("/git/blame", gitBlameHandler)
+	r.Get("/git/branches", listBranchesHandler)
+	r.Post("/git/branches", createBranchHandler)
+	r.Post("/git/branches/rename", renameBranchHandler)
+	r.Delete("/git/branches/*", deleteBranchHandler)
+	r.Post("/git/checkout", checkoutBranchHandler)
+	r.Post("/git/restore", restoreHandler)
 	r.Post("/push_to_production", pushProduction)
+	r.Post("/rollback_production", rollbackProduction)
+	r.Get("/deployments", listDeploymentsHandler)
+	r.Get("/deployments/{id}", getDeploymentHandler)
+	r.Get("/jobs/{id}", getJobHandler)
+	r.Get("/jobs/{id}/stream", jobStreamHandler)
 
 	r.Get("/secrets", GetSecrets)
 	r.Patch("/secrets", UpdateSecrets)
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -26,10 +27,9 @@ func npmInstallHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dir, err := filepath.Abs(filepath.Join("code", path))
+	dir, err := resolveWorkspacePath(path)
 	if err != nil {
-		log.Println("Couldn't convert path to absolute:", err.Error())
-		http.Error(w, "", http.StatusInternalServerError)
+		writeWorkspacePathError(w, err)
 		return
 	}
 
@@ -83,10 +83,9 @@ func npmRemoveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dir, err := filepath.Abs(filepath.Join("code", path))
+	dir, err := resolveWorkspacePath(path)
 	if err != nil {
-		log.Println("Couldn't convert path to absolute:", err.Error())
-		http.Error(w, "", http.StatusInternalServerError)
+		writeWorkspacePathError(w, err)
 		return
 	}
 
@@ -136,14 +135,30 @@ func parseRequestAndPath[T any](w http.ResponseWriter, r *http.Request) (T, stri
 }
 
 func (runner *CommandRunner) RunDockerNpmCommand(args ...string) {
+	runner.RunDockerNodeCommand(append([]string{"npm"}, args...)...)
+}
+
+// RunDockerNodeCommand runs a command in a throwaway node container with runner.dir mounted as /app.
+func (runner *CommandRunner) RunDockerNodeCommand(command ...string) {
+	runner.runDockerNode(nil, command)
+}
+
+// RunDockerNodeCommandAsUser is RunDockerNodeCommand with the container running as fermat's own user
+// instead of root, so whatever it leaves in runner.dir can be cleaned up afterwards.
+func (runner *CommandRunner) RunDockerNodeCommandAsUser(command ...string) {
+	runner.runDockerNode([]string{"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), "-e", "HOME=/tmp"}, command)
+}
+
+func (runner *CommandRunner) runDockerNode(options []string, command []string) {
 	dockerArgs := []string{
 		"run", "--rm",
 		"-v", runner.dir + ":/app",
 		"-w", "/app",
-		"node:18-alpine", "npm",
 	}
+	dockerArgs = append(dockerArgs, options...)
+	dockerArgs = append(dockerArgs, "node:18-alpine")
 
-	dockerArgs = append(dockerArgs, args...)
+	dockerArgs = append(dockerArgs, command...)
 	runner.Run("docker", dockerArgs...)
 }
 
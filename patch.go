@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextPosition is a 1-based line and column like the editor uses. Columns count UTF-16 code units the way
+// Monaco does, so a character outside the BMP (most emoji) takes up two columns.
+type TextPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// TextEdit replaces a range of the base document with Text. The range is either given as Start/End
+// positions or as StartOffset/EndOffset byte offsets.
+type TextEdit struct {
+	Start       *TextPosition `json:"start,omitempty"`
+	End         *TextPosition `json:"end,omitempty"`
+	StartOffset *int          `json:"startOffset,omitempty"`
+	EndOffset   *int          `json:"endOffset,omitempty"`
+	Text        string        `json:"text"`
+}
+
+// PatchError explains exactly which hunk or edit couldn't be applied and why.
+type PatchError struct {
+	Message string `json:"message"`
+	Hunk    int    `json:"hunk,omitempty"`
+	Edit    int    `json:"edit,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+func (e *PatchError) Error() string {
+	switch {
+	case e.Hunk > 0:
+		return fmt.Sprintf("hunk %d: %s", e.Hunk, e.Message)
+	case e.Edit > 0:
+		return fmt.Sprintf("edit %d: %s", e.Edit, e.Message)
+	}
+	return e.Message
+}
+
+type diffHunk struct {
+	header   string
+	oldStart int
+	oldLines int
+	newStart int
+	newLines int
+	lines    []string
+	// noNewline[i] is set when lines[i] was followed by "\ No newline at end of file"
+	noNewline map[int]bool
+}
+
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseUnifiedDiff reads the hunks of a single file unified diff. File headers are skipped.
+func parseUnifiedDiff(diff string) ([]*diffHunk, error) {
+	var hunks []*diffHunk
+	var current *diffHunk
+
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	for _, line := range lines {
+		if match := hunkHeaderRegex.FindStringSubmatch(line); match != nil {
+			current = &diffHunk{
+				header:    match[0],
+				oldStart:  atoiDefault(match[1], 0),
+				oldLines:  atoiDefault(match[2], 1),
+				newStart:  atoiDefault(match[3], 0),
+				newLines:  atoiDefault(match[4], 1),
+				noNewline: make(map[int]bool),
+			}
+			hunks = append(hunks, current)
+			continue
+		}
+
+		if current == nil {
+			// diff --git, index, ---, +++ and anything else before the first hunk
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, `\`):
+			if len(current.lines) > 0 {
+				current.noNewline[len(current.lines)-1] = true
+			}
+		case line == "":
+			// Some tools strip the trailing space off of blank context lines
+			current.lines = append(current.lines, " ")
+		case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+			current.lines = append(current.lines, line)
+		default:
+			return nil, &PatchError{Hunk: len(hunks), Message: fmt.Sprintf("unexpected line in hunk: %q", line)}
+		}
+	}
+
+	if len(hunks) == 0 {
+		return nil, &PatchError{Message: "diff doesn't contain any hunks"}
+	}
+
+	for i, hunk := range hunks {
+		oldCount, newCount := 0, 0
+		for _, line := range hunk.lines {
+			switch line[0] {
+			case ' ':
+				oldCount++
+				newCount++
+			case '-':
+				oldCount++
+			case '+':
+				newCount++
+			}
+		}
+		if oldCount != hunk.oldLines || newCount != hunk.newLines {
+			return nil, &PatchError{Hunk: i + 1, Message: fmt.Sprintf("%s has %d old and %d new lines but the header says %d and %d", hunk.header, oldCount, newCount, hunk.oldLines, hunk.newLines)}
+		}
+	}
+
+	return hunks, nil
+}
+
+func atoiDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// splitLinesKeepEnds splits content into lines that still carry their "\n". Only the last line can be
+// missing it.
+func splitLinesKeepEnds(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// applyUnifiedDiff applies the hunks of diff to content. Hunks must apply exactly at the line numbers
+// given in their headers, there is no fuzzing since a shifted hunk means the base version is wrong.
+func applyUnifiedDiff(content string, diff string) (string, error) {
+	hunks, err := parseUnifiedDiff(diff)
+	if err != nil {
+		return "", err
+	}
+
+	old := splitLinesKeepEnds(content)
+	var out strings.Builder
+	cursor := 0
+
+	for i, hunk := range hunks {
+		// A hunk that only adds lines says "insert after oldStart" rather than "starting at oldStart".
+		start := hunk.oldStart - 1
+		if hunk.oldLines == 0 {
+			start = hunk.oldStart
+		}
+		if start < cursor {
+			return "", &PatchError{Hunk: i + 1, Message: fmt.Sprintf("%s overlaps the previous hunk", hunk.header)}
+		}
+		if start > len(old) {
+			return "", &PatchError{Hunk: i + 1, Line: start + 1, Message: fmt.Sprintf("%s starts past the end of the file (%d lines)", hunk.header, len(old))}
+		}
+
+		for _, line := range old[cursor:start] {
+			out.WriteString(line)
+		}
+		pos := start
+
+		for j, line := range hunk.lines {
+			text := line[1:]
+			if !hunk.noNewline[j] {
+				text += "\n"
+			}
+
+			switch line[0] {
+			case ' ', '-':
+				if pos >= len(old) {
+					return "", &PatchError{Hunk: i + 1, Line: pos + 1, Message: fmt.Sprintf("expected %q but the file ended", strings.TrimSuffix(text, "\n"))}
+				}
+				if old[pos] != text {
+					return "", &PatchError{Hunk: i + 1, Line: pos + 1, Message: fmt.Sprintf("expected %q but found %q", strings.TrimSuffix(text, "\n"), strings.TrimSuffix(old[pos], "\n"))}
+				}
+				if line[0] == ' ' {
+					out.WriteString(text)
+				}
+				pos++
+			case '+':
+				out.WriteString(text)
+			}
+		}
+		cursor = pos
+	}
+
+	for _, line := range old[cursor:] {
+		out.WriteString(line)
+	}
+
+	return out.String(), nil
+}
+
+// onRuneBoundary reports whether the byte offset doesn't point into the middle of a UTF-8 sequence.
+func onRuneBoundary(content string, offset int) bool {
+	return offset >= len(content) || utf8.RuneStart(content[offset])
+}
+
+// applyTextEdits applies a set of non-overlapping edits, all expressed against the original content.
+func applyTextEdits(content string, edits []TextEdit) (string, error) {
+	type span struct {
+		start, end int
+		text       string
+		index      int
+	}
+
+	lineStarts := []int{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+
+	toOffset := func(pos *TextPosition) (int, error) {
+		if pos.Line < 1 || pos.Line > len(lineStarts) {
+			return 0, fmt.Errorf("line %d is outside of the file (%d lines)", pos.Line, len(lineStarts))
+		}
+		if pos.Column < 1 {
+			return 0, fmt.Errorf("column %d is invalid, columns start at 1", pos.Column)
+		}
+		lineStart := lineStarts[pos.Line-1]
+		lineEnd := len(content)
+		if pos.Line < len(lineStarts) {
+			lineEnd = lineStarts[pos.Line] - 1
+		}
+
+		offset, column := lineStart, 1
+		for column < pos.Column {
+			if offset >= lineEnd {
+				return 0, fmt.Errorf("column %d is past the end of line %d", pos.Column, pos.Line)
+			}
+			r, size := utf8.DecodeRuneInString(content[offset:])
+			offset += size
+			column++
+			if r > 0xFFFF {
+				column++
+			}
+		}
+		if column != pos.Column {
+			return 0, fmt.Errorf("column %d on line %d is in the middle of a character", pos.Column, pos.Line)
+		}
+		return offset, nil
+	}
+
+	spans := make([]span, 0, len(edits))
+	for i, edit := range edits {
+		s := span{text: edit.Text, index: i + 1}
+
+		switch {
+		case edit.Start != nil && edit.End != nil:
+			var err error
+			if s.start, err = toOffset(edit.Start); err != nil {
+				return "", &PatchError{Edit: i + 1, Line: edit.Start.Line, Message: err.Error()}
+			}
+			if s.end, err = toOffset(edit.End); err != nil {
+				return "", &PatchError{Edit: i + 1, Line: edit.End.Line, Message: err.Error()}
+			}
+		case edit.StartOffset != nil && edit.EndOffset != nil:
+			s.start, s.end = *edit.StartOffset, *edit.EndOffset
+			if s.start < 0 || s.end > len(content) {
+				return "", &PatchError{Edit: i + 1, Message: fmt.Sprintf("offsets %d-%d are outside of the file (%d bytes)", s.start, s.end, len(content))}
+			}
+			if !onRuneBoundary(content, s.start) || !onRuneBoundary(content, s.end) {
+				return "", &PatchError{Edit: i + 1, Message: fmt.Sprintf("offsets %d-%d split a character", s.start, s.end)}
+			}
+		default:
+			return "", &PatchError{Edit: i + 1, Message: "edit needs either start/end or startOffset/endOffset"}
+		}
+
+		if s.end < s.start {
+			return "", &PatchError{Edit: i + 1, Message: "edit ends before it starts"}
+		}
+		spans = append(spans, s)
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return "", &PatchError{Edit: spans[i].index, Message: fmt.Sprintf("overlaps edit %d", spans[i-1].index)}
+		}
+	}
+
+	var out strings.Builder
+	cursor := 0
+	for _, s := range spans {
+		out.WriteString(content[cursor:s.start])
+		out.WriteString(s.text)
+		cursor = s.end
+	}
+	out.WriteString(content[cursor:])
+
+	return out.String(), nil
+}
+
+type PatchFileRequest struct {
+	Path string `json:"path"`
+	// BaseVersion is the ETag the edits were made against. It's required for ranged edits since offsets
+	// are meaningless against any other version. The If-Match header works too.
+	BaseVersion string     `json:"baseVersion"`
+	Diff        string     `json:"diff,omitempty"`
+	Edits       []TextEdit `json:"edits,omitempty"`
+}
+
+func patchFile(w http.ResponseWriter, r *http.Request) {
+	var req PatchFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if (req.Diff == "") == (len(req.Edits) == 0) {
+		http.Error(w, "Exactly one of diff or edits must be specified", http.StatusBadRequest)
+		return
+	}
+
+	baseVersion := req.BaseVersion
+	if baseVersion == "" {
+		baseVersion = r.Header.Get("If-Match")
+	}
+	if len(req.Edits) > 0 && baseVersion == "" {
+		http.Error(w, "baseVersion is required for ranged edits", http.StatusBadRequest)
+		return
+	}
+
+	path, err := resolveWorkspacePath(req.Path)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	current, err := os.ReadFile(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	if baseVersion != "" {
+		currentETag := ""
+		if exists {
+			currentETag = contentETag(current)
+		}
+		if !etagMatches(baseVersion, currentETag) {
+			writeFileConflict(w, path)
+			return
+		}
+	}
+
+	var patched string
+	if req.Diff != "" {
+		patched, err = applyUnifiedDiff(string(current), req.Diff)
+	} else {
+		patched, err = applyTextEdits(string(current), req.Edits)
+	}
+	if err != nil {
+		var patchErr *PatchError
+		if errors.As(err, &patchErr) {
+			WriteJSONResponseWithHeader(w, http.StatusUnprocessableEntity, patchErr)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
+		return
+	}
+
+	if exists {
+		snapshotBeforeWrite(path)
+	}
+
+	if err := writeFileAtomic(path, []byte(patched)); err != nil {
+		http.Error(w, "Failed to write to file", http.StatusInternalServerError)
+		return
+	}
+	recordFileRevision(path, []byte(patched), HistoryPatch)
+
+	etag := contentETag([]byte(patched))
+	w.Header().Set("ETag", etag)
+	WriteJSONResponse(w, &FileVersionResponse{
+		ETag: etag,
+		Size: len(patched),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var patchBase = "const express = require('express');\nconst app = express();\n\napp.listen(3000);\n"
+
+func Test_ApplyUnifiedDiff(t *testing.T) {
+	diff := `--- a/server.js
++++ b/server.js
+@@ -2,3 +2,4 @@
+ const app = express();
++app.use(express.json());
+ 
+-app.listen(3000);
++app.listen(process.env.PORT);
+`
+	patched, err := applyUnifiedDiff(patchBase, diff)
+	assert.Nil(t, err)
+	assert.Equal(t, "const express = require('express');\nconst app = express();\napp.use(express.json());\n\napp.listen(process.env.PORT);\n", patched)
+
+	_, err = applyUnifiedDiff(patchBase, "@@ -1,1 +1,1 @@\n-const foo = 1;\n+const foo = 2;\n")
+	var patchErr *PatchError
+	assert.True(t, errors.As(err, &patchErr))
+	assert.Equal(t, 1, patchErr.Hunk)
+	assert.Equal(t, 1, patchErr.Line)
+}
+
+func Test_ApplyUnifiedDiffNewFile(t *testing.T) {
+	patched, err := applyUnifiedDiff("", "--- /dev/null\n+++ b/a.txt\n@@ -0,0 +1,2 @@\n+one\n+two\n\\ No newline at end of file\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "one\ntwo", patched)
+}
+
+func Test_ApplyTextEdits(t *testing.T) {
+	start, end := 0, 5
+	patched, err := applyTextEdits(patchBase, []TextEdit{
+		{Start: &TextPosition{Line: 4, Column: 12}, End: &TextPosition{Line: 4, Column: 16}, Text: "8080"},
+		{StartOffset: &start, EndOffset: &end, Text: "let"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "let express = require('express');\nconst app = express();\n\napp.listen(8080);\n", patched)
+
+	_, err = applyTextEdits(patchBase, []TextEdit{
+		{Start: &TextPosition{Line: 1, Column: 1}, End: &TextPosition{Line: 1, Column: 6}, Text: "let"},
+		{StartOffset: &start, EndOffset: &end, Text: "var"},
+	})
+	var patchErr *PatchError
+	assert.True(t, errors.As(err, &patchErr))
+
+	_, err = applyTextEdits(patchBase, []TextEdit{{Start: &TextPosition{Line: 9, Column: 1}, End: &TextPosition{Line: 9, Column: 1}}})
+	assert.True(t, errors.As(err, &patchErr))
+	assert.Equal(t, 9, patchErr.Line)
+}
+
+func Test_ApplyTextEditsUnicode(t *testing.T) {
+	// The emoji is two UTF-16 code units, so "é" is at column 4 in the editor
+	content := "a😀é\n"
+	patched, err := applyTextEdits(content, []TextEdit{{Start: &TextPosition{Line: 1, Column: 4}, End: &TextPosition{Line: 1, Column: 5}, Text: "e"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "a😀e\n", patched)
+
+	var patchErr *PatchError
+	_, err = applyTextEdits(content, []TextEdit{{Start: &TextPosition{Line: 1, Column: 3}, End: &TextPosition{Line: 1, Column: 4}}})
+	assert.True(t, errors.As(err, &patchErr))
+
+	start, end := 2, 5
+	_, err = applyTextEdits(content, []TextEdit{{StartOffset: &start, EndOffset: &end}})
+	assert.True(t, errors.As(err, &patchErr))
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Checks run before pushProduction pushes master to release. FERMAT_PREDEPLOY_CHECKS picks which ones
+// (comma separated, empty to disable them all).
+const (
+	DEFAULT_PREDEPLOY_CHECKS = "frontend,backend,secrets"
+	// Only the end of a check's output is kept, that's where the error is
+	maxPredeployOutput = 16 << 10
+	// Files bigger than this aren't scanned for secrets
+	maxSecretScanBytes = 1 << 20
+)
+
+const (
+	PredeployFrontend = "frontend"
+	PredeployBackend  = "backend"
+	PredeploySecrets  = "secrets"
+)
+
+type PredeployCheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Skipped checks pass, e.g. the frontend check without a frontend/package.json
+	Skipped  bool             `json:"skipped"`
+	Took     int64            `json:"took"`
+	Output   string           `json:"output,omitempty"`
+	Findings []*SecretFinding `json:"findings,omitempty"`
+}
+
+// SecretFinding is something that looks like a credential in the code about to be released. Match is
+// redacted so the response doesn't leak the secret any further.
+type SecretFinding struct {
+	Path string `json:"path"`
+	// Commit is the unpushed commit the secret was found in, empty for uncommitted changes
+	Commit string `json:"commit,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Rule   string `json:"rule"`
+	Match  string `json:"match,omitempty"`
+}
+
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+var secretRules = []*secretRule{
+	{"private-key", regexp.MustCompile(`-----BEGIN ((RSA|EC|DSA|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"aws-access-key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github-token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abpors]-[A-Za-z0-9-]{10,}`)},
+	{"stripe-live-key", regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{20,}\b`)},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"openai-key", regexp.MustCompile(`\bsk-(proj-)?[A-Za-z0-9_\-]{20,}T3BlbkFJ[A-Za-z0-9_\-]{20,}`)},
+	{"sendgrid-key", regexp.MustCompile(`\bSG\.[A-Za-z0-9_\-]{22}\.[A-Za-z0-9_\-]{43}\b`)},
+	{"connection-string-password", regexp.MustCompile(`\b(mongodb(\+srv)?|postgres(ql)?|mysql|redis|amqps?)://[^\s:@/'"]+:[^\s@/'"]{3,}@`)},
+}
+
+func predeployChecks() []string {
+	names, ok := os.LookupEnv("FERMAT_PREDEPLOY_CHECKS")
+	if !ok {
+		names = DEFAULT_PREDEPLOY_CHECKS
+	}
+
+	checks := make([]string, 0)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			checks = append(checks, name)
+		}
+	}
+	return checks
+}
+
+func predeployCheckEnabled(name string) bool {
+	for _, check := range predeployChecks() {
+		if check == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runPredeployChecks runs every configured check against commit, even after one failed, so the caller
+// gets the full picture in one go. The checks build and test a temporary worktree of commit rather than
+// the workspace, so what's checked is exactly what gets pushed and the workspace isn't touched. The
+// secrets check isn't part of this, it runs before committing (see secretsCheck). The output of the
+// checks is also written to stream as they run.
+func runPredeployChecks(root string, commit string, stream io.Writer) ([]*PredeployCheckResult, bool) {
+	if stream == nil {
+		stream = io.Discard
+	}
+
+	results := make([]*PredeployCheckResult, 0)
+	passed := true
+
+	var worktree string
+	defer func() {
+		if worktree != "" {
+			removeCheckWorktree(root, worktree)
+		}
+	}()
+
+	for _, name := range predeployChecks() {
+		if name == PredeploySecrets {
+			continue
+		}
+
+		started := time.Now()
+		fmt.Fprintf(stream, "Running the %s check\n", name)
+
+		var result *PredeployCheckResult
+		if worktree == "" && (name == PredeployFrontend || name == PredeployBackend) {
+			dir, err := addCheckWorktree(root, commit)
+			if err != nil {
+				log.Println("Failed to check out", commit, "for the pre-deploy checks", err.Error())
+				result = &PredeployCheckResult{Output: "Failed to check out the commit to check: " + err.Error()}
+			}
+			worktree = dir
+		}
+
+		switch {
+		case result != nil:
+		case name == PredeployFrontend:
+			result = frontendCheck(worktree, stream)
+		case name == PredeployBackend:
+			result = backendCheck(worktree, stream)
+		default:
+			result = &PredeployCheckResult{Output: fmt.Sprintf("Unknown pre-deploy check %q", name)}
+		}
+
+		result.Name = name
+		result.Took = time.Since(started).Milliseconds()
+		passed = passed && result.Passed
+		results = append(results, result)
+	}
+
+	return results, passed
+}
+
+// addCheckWorktree checks out commit in a new temporary worktree outside of the workspace.
+func addCheckWorktree(root string, commit string) (string, error) {
+	parent, err := fermatStateDir("worktrees")
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(parent, "predeploy-")
+	if err != nil {
+		return "", err
+	}
+
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "worktree", "add", "--detach", dir, commit)
+	if runner.err != nil {
+		os.RemoveAll(dir)
+		return "", runner.err
+	}
+	return dir, nil
+}
+
+// removeCheckWorktree deletes a worktree made by addCheckWorktree, including whatever the checks left in
+// it like node_modules.
+func removeCheckWorktree(root string, dir string) {
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "worktree", "remove", "--force", dir)
+	if runner.err != nil {
+		log.Println("Failed to remove pre-deploy worktree", dir, runner.err.Error())
+		os.RemoveAll(dir)
+		(&CommandRunner{dir: root}).Run("git", "worktree", "prune")
+	}
+}
+
+func tailOutput(output string) string {
+	if len(output) <= maxPredeployOutput {
+		return output
+	}
+	return "..." + output[len(output)-maxPredeployOutput:]
+}
+
+type packageScripts struct {
+	Scripts map[string]string `json:"scripts"`
+}
+
+func readPackageScripts(dir string) (*packageScripts, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	pkg := &packageScripts{}
+	if err := json.Unmarshal(data, pkg); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// runNodeCheck runs a shell script in the node container and turns the outcome into a check result.
+func runNodeCheck(dir string, script string, stream io.Writer) *PredeployCheckResult {
+	runner := &CommandRunner{dir: dir, stream: stream}
+	runner.RunDockerNodeCommandAsUser("sh", "-c", script)
+	if runner.err != nil {
+		log.Println("Pre-deploy check failed in", dir, runner.err.Error())
+		// The error has the command's output too, plus why it failed when it couldn't even start
+		return &PredeployCheckResult{Output: tailOutput(runner.err.Error())}
+	}
+	return &PredeployCheckResult{Passed: true, Output: tailOutput(runner.output)}
+}
+
+// frontendCheck makes sure the frontend installs from its lockfile and builds.
+func frontendCheck(root string, stream io.Writer) *PredeployCheckResult {
+	dir := filepath.Join(root, "frontend")
+	if !fileExists(filepath.Join(dir, "package.json")) {
+		return &PredeployCheckResult{Passed: true, Skipped: true}
+	}
+	return runNodeCheck(dir, "npm ci && npm run build", stream)
+}
+
+// backendCheck makes sure every backend JS file parses, then installs the dependencies and runs the lint
+// and test scripts if the package has them. The check worktree is a fresh checkout without node_modules.
+func backendCheck(root string, stream io.Writer) *PredeployCheckResult {
+	dir := filepath.Join(root, "backend")
+	pkg, err := readPackageScripts(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &PredeployCheckResult{Passed: true, Skipped: true}
+		}
+		return &PredeployCheckResult{Output: "Failed to read backend/package.json: " + err.Error()}
+	}
+
+	steps := []string{
+		`find . -path ./node_modules -prune -o -type f \( -name '*.js' -o -name '*.cjs' -o -name '*.mjs' \) -print0 | xargs -0 -r -n1 node --check`,
+	}
+	scripts := make([]string, 0)
+	if _, ok := pkg.Scripts["lint"]; ok {
+		scripts = append(scripts, "npm run lint")
+	}
+	// npm init puts a test script in every package.json that only fails
+	if test, ok := pkg.Scripts["test"]; ok && !strings.Contains(test, "no test specified") {
+		scripts = append(scripts, "CI=true npm test")
+	}
+	if len(scripts) > 0 {
+		// npm ci refuses to run without a lockfile
+		install := "npm install"
+		if fileExists(filepath.Join(dir, "package-lock.json")) || fileExists(filepath.Join(dir, "npm-shrinkwrap.json")) {
+			install = "npm ci"
+		}
+		steps = append(append(steps, install), scripts...)
+	}
+	return runNodeCheck(dir, strings.Join(steps, " && "), stream)
+}
+
+// isSecretFile matches files that hold credentials no matter what's in them.
+func isSecretFile(name string) bool {
+	base := path.Base(name)
+	switch {
+	case base == ".env":
+		return true
+	case strings.HasPrefix(base, ".env."):
+		suffix := strings.TrimPrefix(base, ".env.")
+		return suffix != "example" && suffix != "sample" && suffix != "template"
+	case base == FEMRAT_KEYS_FILE || base == WEBSERVER_KEYS_FILE:
+		return true
+	case base == "id_rsa" || base == "id_ed25519" || base == "id_ecdsa":
+		return true
+	}
+	return false
+}
+
+func redactSecret(secret string) string {
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:4] + strings.Repeat("*", len(secret)-4)
+}
+
+// scanSecrets returns the lines of content that match one of the secret rules.
+func scanSecrets(name string, content []byte) []*SecretFinding {
+	findings := make([]*SecretFinding, 0)
+	for i, line := range strings.Split(string(content), "\n") {
+		for _, rule := range secretRules {
+			if match := rule.pattern.FindString(line); match != "" {
+				findings = append(findings, &SecretFinding{Path: name, Line: i + 1, Rule: rule.name, Match: redactSecret(match)})
+			}
+		}
+	}
+	return findings
+}
+
+// secretsCheck scans what's about to leave the machine: every commit on master that origin doesn't have
+// yet, and the uncommitted changes that pushProduction is about to commit. Each commit is scanned on its
+// own since a secret that a later commit deletes still ends up in the history on origin. It runs before
+// anything is committed so a secret never even makes it into a local commit.
+func secretsCheck(root string) *PredeployCheckResult {
+	findings := make([]*SecretFinding, 0)
+
+	commitFindings, err := scanUnpushedCommits(root)
+	if err != nil {
+		return &PredeployCheckResult{Output: "Failed to scan the commits to push: " + err.Error()}
+	}
+	findings = append(findings, commitFindings...)
+
+	changeFindings, err := scanUncommittedChanges(root)
+	if err != nil {
+		return &PredeployCheckResult{Output: "Failed to scan the uncommitted changes: " + err.Error()}
+	}
+	findings = append(findings, changeFindings...)
+
+	result := &PredeployCheckResult{Passed: len(findings) == 0, Findings: findings}
+	if !result.Passed {
+		result.Output = fmt.Sprintf("Found %d possible secrets in the code about to be released", len(findings))
+	}
+	return result
+}
+
+func scanSecretFile(name string, size int64, open func() ([]byte, error)) ([]*SecretFinding, error) {
+	if isSecretFile(name) {
+		return []*SecretFinding{{Path: name, Rule: "secret-file"}}, nil
+	}
+	if size > maxSecretScanBytes {
+		return nil, nil
+	}
+	content, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if isBinaryContent(content) {
+		return nil, nil
+	}
+	return scanSecrets(name, content), nil
+}
+
+// scanUnpushedCommits scans the files each commit in origin/master..master adds or changes. Without an
+// origin/master all of master's history is new, without a master there's nothing to scan yet. The caller
+// fetches master beforehand, it's not done here since this runs under gitLock.
+func scanUnpushedCommits(root string) ([]*SecretFinding, error) {
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "rev-parse", "--verify", "--quiet", "refs/heads/master")
+	if runner.err != nil {
+		return make([]*SecretFinding, 0), nil
+	}
+
+	runner = &CommandRunner{dir: root}
+	runner.Run("git", "rev-parse", "--verify", "--quiet", "refs/remotes/origin/master")
+	rangeSpec := "refs/heads/master"
+	if runner.err == nil {
+		rangeSpec = "refs/remotes/origin/master..refs/heads/master"
+	}
+	runner = &CommandRunner{dir: root}
+	runner.Run("git", "rev-list", rangeSpec)
+	if runner.err != nil {
+		return nil, runner.err
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	findings := make([]*SecretFinding, 0)
+	scanned := make(map[plumbing.Hash]bool)
+	for _, hash := range strings.Fields(runner.output) {
+		commit, err := repo.CommitObject(plumbing.NewHash(hash))
+		if err != nil {
+			return nil, err
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+		// Merges are compared to their first parent, the rest of their content was scanned in the merged
+		// commits or is on origin already
+		parentTree := &object.Tree{}
+		if commit.NumParents() > 0 {
+			parent, err := commit.Parent(0)
+			if err != nil {
+				return nil, err
+			}
+			if parentTree, err = parent.Tree(); err != nil {
+				return nil, err
+			}
+		}
+
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			if change.To.Name == "" || !change.To.TreeEntry.Mode.IsFile() {
+				continue
+			}
+			// A .env is reported by its name, even when the same content was already scanned elsewhere
+			if isSecretFile(change.To.Name) {
+				findings = append(findings, &SecretFinding{Path: change.To.Name, Commit: hash, Rule: "secret-file"})
+				continue
+			}
+			// The same content only needs to be scanned once, e.g. when a commit is reverted and redone
+			if scanned[change.To.TreeEntry.Hash] {
+				continue
+			}
+			scanned[change.To.TreeEntry.Hash] = true
+
+			file, err := tree.TreeEntryFile(&change.To.TreeEntry)
+			if err != nil {
+				return nil, err
+			}
+			fileFindings, err := scanSecretFile(change.To.Name, file.Size, func() ([]byte, error) {
+				reader, err := file.Reader()
+				if err != nil {
+					return nil, err
+				}
+				defer reader.Close()
+				return io.ReadAll(reader)
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, finding := range fileFindings {
+				finding.Commit = hash
+			}
+			findings = append(findings, fileFindings...)
+		}
+	}
+	return findings, nil
+}
+
+// scanUncommittedChanges scans the files `git add .` would commit: the ones that differ from HEAD and the
+// untracked ones that aren't ignored. In a repo without any commits yet, everything is new.
+func scanUncommittedChanges(root string) ([]*SecretFinding, error) {
+	runner := &CommandRunner{dir: root}
+	runner.Run("git", "rev-parse", "--verify", "--quiet", "HEAD")
+	hasHead := runner.err == nil
+
+	runner = &CommandRunner{dir: root}
+	changed := ""
+	if hasHead {
+		runner.Run("git", "diff", "--name-only", "--no-renames", "-z", "HEAD")
+		changed = runner.output
+		runner.Run("git", "ls-files", "--others", "--exclude-standard", "-z")
+	} else {
+		runner.Run("git", "ls-files", "--cached", "--others", "--exclude-standard", "-z")
+	}
+	if runner.err != nil {
+		return nil, runner.err
+	}
+
+	findings := make([]*SecretFinding, 0)
+	for _, name := range strings.Split(changed+runner.output, "\x00") {
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(name))
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			// Deleted files don't add anything
+			continue
+		}
+		fileFindings, err := scanSecretFile(name, info.Size(), func() ([]byte, error) {
+			return os.ReadFile(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, fileFindings...)
+	}
+	return findings, nil
+}
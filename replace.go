@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// DEFAULT_REPLACE_MAX_MATCHES caps how many matches a preview returns.
+const DEFAULT_REPLACE_MAX_MATCHES = 5000
+
+// ReplaceSearch is the search part of both replace requests. Apply must send the same search it
+// previewed with, the match ids are only meaningful for that search.
+type ReplaceSearch struct {
+	Query         string   `json:"query"`
+	Replacement   string   `json:"replacement"`
+	Regex         bool     `json:"regex"`
+	CaseSensitive bool     `json:"caseSensitive"`
+	WholeWord     bool     `json:"wholeWord"`
+	Include       []string `json:"include"`
+	Exclude       []string `json:"exclude"`
+	Path          string   `json:"path"`
+}
+
+// ReplaceMatch is one occurrence in a file. ID is its position among the file's matches and is what
+// apply uses to select it. Line and Column are 1-based, Column counts runes.
+type ReplaceMatch struct {
+	ID          int    `json:"id"`
+	Line        int    `json:"line"`
+	Column      int    `json:"column"`
+	Text        string `json:"text"`
+	Match       string `json:"match"`
+	Replacement string `json:"replacement"`
+
+	start int
+	end   int
+}
+
+type ReplaceFilePreview struct {
+	Path    string          `json:"path"`
+	ETag    string          `json:"etag"`
+	Matches []*ReplaceMatch `json:"matches"`
+}
+
+type ReplacePreviewResponse struct {
+	Files   []*ReplaceFilePreview `json:"files"`
+	Total   int                   `json:"total"`
+	Limited bool                  `json:"limited"`
+}
+
+type ReplaceFileSelection struct {
+	Path string `json:"path"`
+	// ETag is the version token the file had in the preview
+	ETag string `json:"etag"`
+	// Matches are the ids to replace, every match in the file when omitted
+	Matches []int `json:"matches"`
+}
+
+type ReplaceApplyRequest struct {
+	ReplaceSearch
+	Files []*ReplaceFileSelection `json:"files"`
+}
+
+type ReplacedFile struct {
+	Path         string `json:"path"`
+	ETag         string `json:"etag"`
+	Replacements int    `json:"replacements"`
+}
+
+type ReplaceConflictResponse struct {
+	Message string   `json:"message"`
+	Paths   []string `json:"paths"`
+}
+
+func (search *ReplaceSearch) matcher() (*grepMatcher, error) {
+	opts := &grepOptions{
+		Query:         search.Query,
+		Regex:         search.Regex,
+		CaseSensitive: search.CaseSensitive,
+		WholeWord:     search.WholeWord,
+		Include:       search.Include,
+		Exclude:       search.Exclude,
+		Dir:           search.Path,
+	}
+	return opts.compile()
+}
+
+// findReplacements lists every non-empty match in content along with what it would be replaced by. For
+// regex searches the replacement may refer to capture groups as $1 or ${name}.
+func (m *grepMatcher) findReplacements(content []byte, replacement string, regex bool) []*ReplaceMatch {
+	matches := make([]*ReplaceMatch, 0)
+	lineNumber, lineStart := 1, 0
+
+	for _, location := range m.pattern.FindAllSubmatchIndex(content, -1) {
+		if location[0] == location[1] {
+			continue
+		}
+
+		for {
+			end := bytes.IndexByte(content[lineStart:], '\n')
+			if end < 0 || lineStart+end >= location[0] {
+				break
+			}
+			lineStart += end + 1
+			lineNumber++
+		}
+		lineEnd := len(content)
+		if end := bytes.IndexByte(content[lineStart:], '\n'); end >= 0 {
+			lineEnd = lineStart + end
+		}
+
+		value := []byte(replacement)
+		if regex {
+			value = m.pattern.Expand(nil, value, content, location)
+		}
+
+		matches = append(matches, &ReplaceMatch{
+			ID:          len(matches),
+			Line:        lineNumber,
+			Column:      utf8.RuneCount(content[lineStart:location[0]]) + 1,
+			Text:        strings.TrimSuffix(string(content[lineStart:lineEnd]), "\r"),
+			Match:       string(content[location[0]:location[1]]),
+			Replacement: string(value),
+			start:       location[0],
+			end:         location[1],
+		})
+	}
+	return matches
+}
+
+// replaceMatches returns content with the given matches replaced. Matches must be in order.
+func replaceMatches(content []byte, matches []*ReplaceMatch) []byte {
+	var result bytes.Buffer
+	last := 0
+	for _, match := range matches {
+		result.Write(content[last:match.start])
+		result.WriteString(match.Replacement)
+		last = match.end
+	}
+	result.Write(content[last:])
+	return result.Bytes()
+}
+
+// replacePreviewHandler is the first phase of find and replace. It returns every match with its proposed
+// replacement, grouped per file along with the file's ETag to send back when applying.
+func replacePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReplaceSearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "A query must be specified", http.StatusBadRequest)
+		return
+	}
+
+	matcher, err := req.matcher()
+	if err != nil {
+		http.Error(w, "Invalid search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+	dir, err := resolveWorkspacePath(req.Path)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	files := make(chan string, 256)
+	go func() {
+		defer close(files)
+		if err := walkGrepFiles(ctx, root, dir, matcher, files); err != nil && ctx.Err() == nil {
+			log.Printf("Error walking workspace for replace: %v", err)
+		}
+	}()
+
+	limit := int(envInt64("FERMAT_REPLACE_MAX_MATCHES", DEFAULT_REPLACE_MAX_MATCHES))
+	response := &ReplacePreviewResponse{Files: make([]*ReplaceFilePreview, 0)}
+	for path := range files {
+		if response.Limited {
+			continue
+		}
+
+		content, ok := readSearchableFile(path)
+		if !ok {
+			continue
+		}
+
+		matches := matcher.findReplacements(content, req.Replacement, req.Regex)
+		if len(matches) == 0 {
+			continue
+		}
+
+		// Files are never cut in half, a file's matches are either all there or not at all.
+		if response.Total+len(matches) > limit && response.Total > 0 {
+			response.Limited = true
+			cancel()
+			continue
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		response.Files = append(response.Files, &ReplaceFilePreview{
+			Path:    filepath.ToSlash(rel),
+			ETag:    contentETag(content),
+			Matches: matches,
+		})
+		response.Total += len(matches)
+	}
+
+	WriteJSONResponse(w, response)
+}
+
+// replaceApplyHandler is the second phase of find and replace. Every selected file has to be unchanged
+// since the preview or nothing is written at all. If writing one of the files fails, the files already
+// written are put back the way they were.
+func replaceApplyHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReplaceApplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Query == "" || len(req.Files) == 0 {
+		http.Error(w, "A query and at least one file must be specified", http.StatusBadRequest)
+		return
+	}
+
+	matcher, err := req.matcher()
+	if err != nil {
+		http.Error(w, "Invalid search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type pendingReplace struct {
+		selection *ReplaceFileSelection
+		path      string
+		original  []byte
+		updated   []byte
+		count     int
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	pending := make([]*pendingReplace, 0, len(req.Files))
+	stale := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, selection := range req.Files {
+		path, err := resolveWorkspacePath(selection.Path)
+		if err != nil {
+			writeWorkspacePathError(w, err)
+			return
+		}
+		if seen[path] {
+			http.Error(w, "File listed more than once: "+selection.Path, http.StatusBadRequest)
+			return
+		}
+		seen[path] = true
+
+		original, err := os.ReadFile(path)
+		if err != nil || !etagMatches(selection.ETag, contentETag(original)) {
+			stale = append(stale, selection.Path)
+			continue
+		}
+
+		matches := matcher.findReplacements(original, req.Replacement, req.Regex)
+		if selection.Matches != nil {
+			selected := make([]*ReplaceMatch, 0, len(selection.Matches))
+			wanted := make(map[int]bool)
+			for _, id := range selection.Matches {
+				wanted[id] = true
+			}
+			for _, match := range matches {
+				if wanted[match.ID] {
+					selected = append(selected, match)
+				}
+			}
+			if len(selected) != len(wanted) {
+				http.Error(w, "Unknown match selected in "+selection.Path, http.StatusBadRequest)
+				return
+			}
+			matches = selected
+		}
+
+		pending = append(pending, &pendingReplace{
+			selection: selection,
+			path:      path,
+			original:  original,
+			updated:   replaceMatches(original, matches),
+			count:     len(matches),
+		})
+	}
+
+	if len(stale) > 0 {
+		WriteJSONResponseWithHeader(w, http.StatusConflict, &ReplaceConflictResponse{
+			Message: "Files were modified since the preview, nothing was replaced",
+			Paths:   stale,
+		})
+		return
+	}
+
+	written := make([]*pendingReplace, 0, len(pending))
+	for _, file := range pending {
+		if file.count == 0 {
+			continue
+		}
+		if err := writeFileAtomic(file.path, file.updated); err != nil {
+			for _, done := range written {
+				if rerr := writeFileAtomic(done.path, done.original); rerr != nil {
+					log.Printf("[Error] Failed to roll back %s: %v", done.path, rerr)
+				}
+			}
+			http.Error(w, "Failed to write "+file.selection.Path+", no files were changed", http.StatusInternalServerError)
+			return
+		}
+		written = append(written, file)
+	}
+
+	replaced := make([]*ReplacedFile, 0, len(pending))
+	for _, file := range pending {
+		if file.count > 0 {
+			recordFileRevision(file.path, file.original, HistoryDisk)
+			recordFileRevision(file.path, file.updated, HistoryReplace)
+		}
+		replaced = append(replaced, &ReplacedFile{
+			Path:         file.selection.Path,
+			ETag:         contentETag(file.updated),
+			Replacements: file.count,
+		})
+	}
+
+	WriteJSONResponse(w, replaced)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FindReplacements(t *testing.T) {
+	search := &ReplaceSearch{Query: `process\.env\.MONGO_(\w+)`, Regex: true, CaseSensitive: true}
+	matcher, err := search.matcher()
+	assert.Nil(t, err)
+
+	content := []byte("const a = process.env.MONGO_URL;\nconst b = process.env.MONGO_DB || process.env.MONGO_URL;\n")
+	matches := matcher.findReplacements(content, "process.env.DB_$1", true)
+	assert.Equal(t, 3, len(matches))
+	assert.Equal(t, 2, matches[2].Line)
+	assert.Equal(t, 35, matches[2].Column)
+	assert.Equal(t, "process.env.DB_URL", matches[2].Replacement)
+
+	assert.Equal(t, "const a = process.env.MONGO_URL;\nconst b = process.env.DB_DB || process.env.DB_URL;\n", string(replaceMatches(content, matches[1:])))
+}
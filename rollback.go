@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type RollbackProductionRequest struct {
+	// Target is a tag or commit from the history of release
+	Target string `json:"target"`
+	// TriggeredBy names who asked for the rollback, it's only recorded in the deployment ledger
+	TriggeredBy string `json:"triggeredBy"`
+}
+
+// rollbackRelease adds a commit on top of origin/release whose content is exactly target's, i.e. a revert of
+// everything released since target. It's built from the trees directly so the worktree isn't touched.
+func rollbackRelease(runner *CommandRunner, target string, message string) (string, error) {
+	runner.Run("git", "commit-tree", target+"^{tree}", "-p", "refs/remotes/origin/release", "-m", message)
+	return strings.TrimSpace(runner.output), runner.err
+}
+
+// keepReleaseInMaster records commit in the history of master without changing master's content (like
+// `git merge -s ours`), so the next push of master to release is a fast-forward again.
+func keepReleaseInMaster(runner *CommandRunner, commit string) error {
+	runner.Run("git", "rev-parse", "--verify", "refs/heads/master")
+	if runner.err != nil {
+		return runner.err
+	}
+	master := strings.TrimSpace(runner.output)
+
+	runner.Run("git", "merge-base", "--is-ancestor", commit, master)
+	if runner.err == nil {
+		return nil
+	}
+	// Exit status 1 means it's not an ancestor, which is the expected case. Anything else is an error.
+	if runner.exitCode != 1 {
+		return runner.err
+	}
+	runner.err = nil
+
+	runner.Run("git", "commit-tree", master+"^{tree}", "-p", master, "-p", commit, "-m", "housekeeping: keep release history after rollback")
+	merge := strings.TrimSpace(runner.output)
+	runner.Run("git", "update-ref", "-m", "fermat: rollback of release", "refs/heads/master", merge, master)
+	return runner.err
+}
+
+// rollbackProduction moves release back to a previous release by pushing a revert commit, release is never
+// force-pushed. The rollback is tagged and recorded in the deployment ledger like any other deployment.
+// It runs as a job, the response only says which one.
+func rollbackProduction(w http.ResponseWriter, r *http.Request) {
+	var req RollbackProductionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Target == "" || strings.HasPrefix(req.Target, "-") {
+		http.Error(w, "Field target must be a tag or commit", http.StatusBadRequest)
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, "Failed to find workspace", http.StatusInternalServerError)
+		return
+	}
+
+	// A rollback takes the deploy slot like any deploy, so it can't interleave with a push to production
+	job, running := startDeployJob(JobRollbackProduction)
+	if running != nil {
+		WriteJSONResponseWithHeader(w, http.StatusConflict, &JobInProgressResponse{
+			Message: "A deploy is already in progress",
+			ID:      running.ID,
+		})
+		return
+	}
+
+	runJob(job, func() *PushProductionResponse {
+		return runRollbackProduction(root, &req, job)
+	})
+
+	WriteJSONResponseWithHeader(w, http.StatusAccepted, &JobStartedResponse{ID: job.ID, Kind: job.Kind})
+}
+
+// runRollbackProduction only holds gitLock while it commits and pushes the rollback, fetching release
+// and finding the target happen before.
+func runRollbackProduction(root string, req *RollbackProductionRequest, job *Job) *PushProductionResponse {
+	deployment := &Deployment{
+		Kind:        DeploymentRollback,
+		StartedAt:   time.Now(),
+		Target:      req.Target,
+		TriggeredBy: req.TriggeredBy,
+	}
+	finish := func(response *PushProductionResponse) *PushProductionResponse {
+		deployment.FinishedAt = time.Now()
+		deployment.Status = response.Status
+		deployment.Message = response.Message
+		deployment.Commit = response.Commit
+		deployment.Tag = response.Tag
+		recordDeployment(deployment)
+		return response
+	}
+	failed := func(err error) *PushProductionResponse {
+		log.Println("Failed to roll back production", err.Error())
+		return finish(&PushProductionResponse{
+			Status:  Failed,
+			Message: err.Error(),
+		})
+	}
+
+	job.SetPhase("fetching")
+	runner := &CommandRunner{dir: root, stream: job}
+	runner.Run("git", "fetch", "--tags", "origin", "release")
+	if runner.err != nil {
+		return failed(runner.err)
+	}
+
+	runner.Run("git", "rev-parse", "refs/remotes/origin/release")
+	deployment.Previous = strings.TrimSpace(runner.output)
+
+	runner.Run("git", "rev-parse", "--verify", "--quiet", req.Target+"^{commit}")
+	if runner.err != nil {
+		return failed(fmt.Errorf("Unknown tag or commit %s", req.Target))
+	}
+	target := strings.TrimSpace(runner.output)
+
+	runner.Run("git", "merge-base", "--is-ancestor", target, "refs/remotes/origin/release")
+	if runner.err != nil {
+		if runner.exitCode == 1 {
+			return failed(fmt.Errorf("%s was never released", req.Target))
+		}
+		return failed(runner.err)
+	}
+
+	runner.Run("git", "rev-parse", "refs/remotes/origin/release^{tree}", target+"^{tree}")
+	if trees := strings.Fields(runner.output); runner.err == nil && len(trees) == 2 && trees[0] == trees[1] {
+		return finish(&PushProductionResponse{
+			Status:  NoChanges,
+			Message: fmt.Sprintf("Production already runs %s", req.Target),
+			Commit:  deployment.Previous,
+		})
+	}
+
+	message := fmt.Sprintf("swizzle rollback production to %s: %s", req.Target, deployment.StartedAt.Format(time.RFC3339))
+
+	job.SetPhase("pushing")
+	commit, tag, err := pushRollback(root, target, message, deployment.StartedAt, job)
+	if err != nil {
+		return failed(err)
+	}
+
+	if stat, err := deploymentDiffStat(root, deployment.Previous, commit); err == nil {
+		deployment.DiffStat = stat
+	} else {
+		log.Println("Failed to compute deployment diffstat", err.Error())
+	}
+
+	job.SetPhase("done")
+	return finish(&PushProductionResponse{
+		Status:  BuildTriggered,
+		Message: fmt.Sprintf("Rolled back production to %s", req.Target),
+		Commit:  commit,
+		Tag:     tag,
+	})
+}
+
+// pushRollback commits the rollback to target on top of origin/release, tags it and pushes both. Master
+// gets the rollback in its history afterwards.
+func pushRollback(root string, target string, message string, at time.Time, job *Job) (string, string, error) {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	runner := &CommandRunner{dir: root, stream: job}
+	commit, err := rollbackRelease(runner, target, message)
+	if err != nil {
+		return "", "", err
+	}
+
+	tag, err := tagDeployment(runner, DeploymentRollback, commit, message, at)
+	if err != nil {
+		return "", "", err
+	}
+	// Atomic so the tag only exists when release actually moved
+	runner.Run("git", "push", "--atomic", "-o", "nokeycheck", "origin", commit+":refs/heads/release", "refs/tags/"+tag)
+	if runner.err != nil {
+		untagDeployment(root, tag)
+		return "", "", runner.err
+	}
+
+	// Release was pushed, failing to update master locally is only worth a log line since the next
+	// pushProduction reports it anyway.
+	if err := keepReleaseInMaster(&CommandRunner{dir: root}, commit); err != nil {
+		log.Println("Failed to record the rollback in master", err.Error())
+	}
+	return commit, tag, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RollbackProduction(t *testing.T) {
+	root := initTestRepo(t)
+	origin := initTestOrigin(t, root)
+	t.Setenv("FERMAT_PREDEPLOY_CHECKS", "")
+
+	deploy := func(content string) *PushProductionResponse {
+		assert.Nil(t, os.WriteFile(filepath.Join(root, "server.js"), []byte(content), 0644))
+		job, running := startDeployJob(JobPushProduction)
+		assert.Nil(t, running)
+		response := runPushProduction(root, &PushProductionRequest{}, job)
+		job.Finish(response)
+		assert.Equal(t, BuildTriggered, response.Status, response.Message)
+		return response
+	}
+	rollback := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rollbackProduction(w, httptest.NewRequest(http.MethodPost, "/rollback_production", strings.NewReader(`{"target": "`+target+`"}`)))
+		return w
+	}
+
+	first := deploy("console.log('first')\n")
+	deploy("console.log('second')\n")
+
+	// A rollback waits its turn like any other deploy
+	job, _ := startDeployJob(JobPushProduction)
+	w := rollback(first.Tag)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), job.ID)
+	job.Finish(&PushProductionResponse{Status: NoChanges})
+
+	w = rollback(first.Tag)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var started JobStartedResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &started))
+	assert.Equal(t, JobRollbackProduction, started.Kind)
+
+	_, events, unsubscribe := getJob(started.ID).Subscribe()
+	defer unsubscribe()
+	for range events {
+	}
+	result := getJob(started.ID).snapshot().Result
+	assert.Equal(t, BuildTriggered, result.Status, result.Message)
+	assert.Nil(t, activeDeployJob())
+	assert.Equal(t, result.Commit, runTestGit(t, root, "rev-parse", "refs/remotes/origin/release"))
+	assert.Equal(t, "console.log('first')", runTestGit(t, origin, "show", "release:server.js"))
+	// Release was reverted on top of the previous release, not force-pushed
+	assert.Equal(t, "console.log('second')", runTestGit(t, origin, "show", "release~1:server.js"))
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_SYMBOLS_LIMIT    = 200
+	MAX_SYMBOLS_LIMIT        = 2000
+	DEFAULT_REFERENCES_LIMIT = 1000
+)
+
+type SymbolKind string
+
+const (
+	SymbolFunction  SymbolKind = "function"
+	SymbolClass     SymbolKind = "class"
+	SymbolConst     SymbolKind = "const"
+	SymbolVariable  SymbolKind = "variable"
+	SymbolComponent SymbolKind = "component"
+	SymbolRoute     SymbolKind = "route"
+	SymbolInterface SymbolKind = "interface"
+	SymbolType      SymbolKind = "type"
+	SymbolEnum      SymbolKind = "enum"
+)
+
+// Symbol is a top-level declaration in a JS/TS file. Line and Column are 1-based, Column counts runes.
+// For routes Name is the method and path, e.g. "GET /api/users".
+type Symbol struct {
+	Name     string     `json:"name"`
+	Kind     SymbolKind `json:"kind"`
+	Path     string     `json:"path"`
+	Line     int        `json:"line"`
+	Column   int        `json:"column"`
+	Exported bool       `json:"exported"`
+	Text     string     `json:"text"`
+}
+
+var symbolFileExtensions = map[string]bool{
+	".js":  true,
+	".jsx": true,
+	".mjs": true,
+	".cjs": true,
+	".ts":  true,
+	".tsx": true,
+}
+
+// Declarations are recognized line by line with these expressions. That's far from a real parser but
+// covers the way people (and code generators) write Express backends and React frontends. Only
+// unindented lines are considered top-level, except for routes which are often registered inside a
+// setup function. Routes are only picked up on receivers named like an Express app or router so that
+// axios.get("/api/...") calls in the frontend don't show up as routes.
+var (
+	functionDeclRegex = regexp.MustCompile(`^(export\s+(?:default\s+)?)?(?:async\s+)?function\s*\*?\s*([A-Za-z_$][\w$]*)`)
+	classDeclRegex    = regexp.MustCompile(`^(export\s+(?:default\s+)?)?(?:abstract\s+)?class\s+([A-Za-z_$][\w$]*)`)
+	varDeclRegex      = regexp.MustCompile(`^(export\s+)?(const|let|var)\s+([A-Za-z_$][\w$]*)\s*(?::[^=]+)?=\s*(.*)$`)
+	tsDeclRegex       = regexp.MustCompile(`^(export\s+)?(?:declare\s+)?(interface|type|enum|const\s+enum)\s+([A-Za-z_$][\w$]*)`)
+	commonJSRegex     = regexp.MustCompile(`^(?:module\.)?exports\.([A-Za-z_$][\w$]*)\s*=\s*(.*)$`)
+	routeRegex        = regexp.MustCompile(`\b(?:app|server|routes?|[\w$]*[Rr]outer)\.(get|post|put|patch|delete|all|use)\(\s*(['"` + "`" + `])([^'"` + "`" + `]*)['"` + "`" + `]`)
+	functionValue     = regexp.MustCompile(`^(?:async\s+)?(?:function\b|\([^)]*\)\s*(?::[^=]+)?=>|[A-Za-z_$][\w$]*\s*=>|(?:React\.)?(?:memo|forwardRef)\()`)
+)
+
+// extractSymbols finds the top-level declarations and Express routes in a JS/TS file.
+func extractSymbols(rel string, content []byte) []*Symbol {
+	ext := strings.ToLower(filepath.Ext(rel))
+	jsx := ext == ".jsx" || ext == ".tsx"
+
+	symbols := make([]*Symbol, 0)
+	add := func(name string, kind SymbolKind, exported bool, line int, text string) {
+		column := 1
+		if i := strings.Index(text, name); i >= 0 && kind != SymbolRoute {
+			column = utf8.RuneCountInString(text[:i]) + 1
+		}
+		symbols = append(symbols, &Symbol{
+			Name:     name,
+			Kind:     kind,
+			Path:     rel,
+			Line:     line,
+			Column:   column,
+			Exported: exported,
+			Text:     strings.TrimSpace(text),
+		})
+	}
+
+	// A capitalized function in a JSX file is a React component
+	functionKind := func(name string) SymbolKind {
+		if jsx && name != "" && unicode.IsUpper([]rune(name)[0]) {
+			return SymbolComponent
+		}
+		return SymbolFunction
+	}
+
+	inComment := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), len(content)+1)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(text)
+
+		if inComment {
+			if strings.Contains(trimmed, "*/") {
+				inComment = false
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "/*") {
+			inComment = !strings.Contains(trimmed, "*/")
+			continue
+		}
+		if strings.HasPrefix(trimmed, "//") || trimmed == "" {
+			continue
+		}
+
+		for _, match := range routeRegex.FindAllStringSubmatch(text, -1) {
+			if strings.HasPrefix(match[3], "/") || match[3] == "*" {
+				add(strings.ToUpper(match[1])+" "+match[3], SymbolRoute, false, number, text)
+			}
+		}
+
+		if text != trimmed {
+			continue
+		}
+
+		if match := functionDeclRegex.FindStringSubmatch(text); match != nil {
+			add(match[2], functionKind(match[2]), match[1] != "", number, text)
+		} else if match := classDeclRegex.FindStringSubmatch(text); match != nil {
+			kind := SymbolClass
+			if jsx && strings.Contains(text, "Component") {
+				kind = SymbolComponent
+			}
+			add(match[2], kind, match[1] != "", number, text)
+		} else if match := tsDeclRegex.FindStringSubmatch(text); match != nil {
+			kind := SymbolKind(match[2])
+			if kind == "const enum" {
+				kind = SymbolEnum
+			}
+			add(match[3], kind, match[1] != "", number, text)
+		} else if match := varDeclRegex.FindStringSubmatch(text); match != nil {
+			exported := match[1] != ""
+			var kind SymbolKind
+			switch {
+			case functionValue.MatchString(match[4]):
+				kind = functionKind(match[3])
+			case match[2] == "const" && exported:
+				kind = SymbolConst
+			case exported:
+				kind = SymbolVariable
+			default:
+				// Non exported constants are implementation details, mostly require()s
+				continue
+			}
+			add(match[3], kind, exported, number, text)
+		} else if match := commonJSRegex.FindStringSubmatch(text); match != nil {
+			kind := SymbolVariable
+			if functionValue.MatchString(match[2]) {
+				kind = functionKind(match[1])
+			}
+			add(match[1], kind, true, number, text)
+		}
+	}
+
+	return symbols
+}
+
+// symbolIndex holds the symbols of every JS/TS file in the workspace, updated incrementally by the
+// workspace watcher.
+type symbolIndex struct {
+	root string
+
+	mu    sync.RWMutex
+	files map[string][]*Symbol
+}
+
+var (
+	symbolIndexLock sync.Mutex
+	sharedSymbols   *symbolIndex
+)
+
+// getSymbolIndex builds the symbol index the first time it's needed and returns it afterwards. A failed build
+// isn't remembered so the next call gets to try again.
+func getSymbolIndex() (*symbolIndex, error) {
+	symbolIndexLock.Lock()
+	defer symbolIndexLock.Unlock()
+
+	if sharedSymbols == nil {
+		index, err := newSymbolIndex()
+		if err != nil {
+			return nil, err
+		}
+		sharedSymbols = index
+	}
+	return sharedSymbols, nil
+}
+
+func newSymbolIndex() (*symbolIndex, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := getWorkspaceWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	index := &symbolIndex{
+		root:  root,
+		files: make(map[string][]*Symbol),
+	}
+
+	// Subscribe before walking so nothing saved during the walk is missed.
+	events, unsubscribe := watcher.Subscribe()
+	if err := index.indexDir(root); err != nil {
+		unsubscribe()
+		return nil, err
+	}
+
+	go func() {
+		for batch := range events {
+			for _, event := range batch {
+				index.handleEvent(event)
+			}
+		}
+	}()
+
+	log.Printf("Symbol index ready with %d files", len(index.files))
+	return index, nil
+}
+
+func (index *symbolIndex) indexDir(dir string) error {
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != index.root && ignore.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			index.indexFile(path)
+		}
+		return nil
+	})
+}
+
+// indexFile (re)extracts the symbols of a single file. Files that aren't JS/TS, are too big or look
+// binary are left out, the same way the full-text index leaves them out.
+func (index *symbolIndex) indexFile(path string) {
+	if !symbolFileExtensions[strings.ToLower(filepath.Ext(path))] {
+		return
+	}
+
+	rel, err := filepath.Rel(index.root, path)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > envInt64("FERMAT_INDEX_MAX_FILE_BYTES", DEFAULT_INDEX_MAX_FILE_BYTES) {
+		index.removeFile(path)
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || isBinaryContent(content) {
+		index.removeFile(path)
+		return
+	}
+
+	symbols := extractSymbols(rel, content)
+
+	index.mu.Lock()
+	index.files[rel] = symbols
+	index.mu.Unlock()
+}
+
+// removeFile forgets path, and everything underneath it in case it was a directory.
+func (index *symbolIndex) removeFile(path string) {
+	rel, err := filepath.Rel(index.root, path)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	prefix := rel + "/"
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	for existing := range index.files {
+		if existing == rel || strings.HasPrefix(existing, prefix) {
+			delete(index.files, existing)
+		}
+	}
+}
+
+func (index *symbolIndex) handleEvent(event FileEvent) {
+	switch event.Op {
+	case FileCreated, FileWritten:
+		if event.IsDir {
+			index.indexDir(event.Path)
+		} else {
+			index.indexFile(event.Path)
+		}
+	case FileRemoved, FileRenamed:
+		index.removeFile(event.Path)
+	case FileResync:
+		index.rebuild()
+	}
+}
+
+// rebuild indexes the workspace again and swaps in the result, for when watcher events were dropped.
+func (index *symbolIndex) rebuild() {
+	fresh := &symbolIndex{root: index.root, files: make(map[string][]*Symbol)}
+	if err := fresh.indexDir(index.root); err != nil {
+		log.Println("Failed to rebuild the symbol index", err.Error())
+		return
+	}
+
+	index.mu.Lock()
+	index.files = fresh.files
+	index.mu.Unlock()
+}
+
+// fileSymbols returns the outline of a single file, in source order.
+func (index *symbolIndex) fileSymbols(rel string) []*Symbol {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	symbols := make([]*Symbol, len(index.files[rel]))
+	copy(symbols, index.files[rel])
+	return symbols
+}
+
+// find returns every symbol underneath the dir prefix accepted by keep.
+func (index *symbolIndex) find(dir string, keep func(symbol *Symbol) bool) []*Symbol {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	symbols := make([]*Symbol, 0)
+	for rel, fileSymbols := range index.files {
+		if !inScope(rel, dir) {
+			continue
+		}
+		for _, symbol := range fileSymbols {
+			if keep(symbol) {
+				symbols = append(symbols, symbol)
+			}
+		}
+	}
+	return symbols
+}
+
+// inScope reports whether the file rel is dir itself or underneath it. An empty dir is the whole workspace.
+func inScope(rel string, dir string) bool {
+	return dir == "" || rel == dir || strings.HasPrefix(rel, dir+"/")
+}
+
+// relWorkspacePath resolves the path param and returns it relative to the workspace root, "" for the
+// root itself.
+func relWorkspacePath(param string) (string, string, error) {
+	path, err := resolveWorkspacePath(param)
+	if err != nil {
+		return "", "", err
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		return "", "", err
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", "", err
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return path, filepath.ToSlash(rel), nil
+}
+
+// symbolsHandler returns the outline of a file when path is a file. Otherwise it searches the symbols of
+// the whole workspace (or the directory in path) for names containing q, best matches first.
+func symbolsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	path, rel, err := relWorkspacePath(query.Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	limit := DEFAULT_SYMBOLS_LIMIT
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > MAX_SYMBOLS_LIMIT {
+			http.Error(w, "Param limit must be between 1 and "+strconv.Itoa(MAX_SYMBOLS_LIMIT), http.StatusBadRequest)
+			return
+		}
+	}
+
+	index, err := getSymbolIndex()
+	if err != nil {
+		log.Println("Failed to build symbol index", err.Error())
+		http.Error(w, "Failed to build symbol index", http.StatusInternalServerError)
+		return
+	}
+
+	kinds := make(map[SymbolKind]bool)
+	for _, kind := range splitGlobs(query.Get("kind")) {
+		kinds[SymbolKind(kind)] = true
+	}
+
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		symbols := make([]*Symbol, 0)
+		for _, symbol := range index.fileSymbols(rel) {
+			if len(kinds) == 0 || kinds[symbol.Kind] {
+				symbols = append(symbols, symbol)
+			}
+		}
+		WriteJSONResponse(w, symbols)
+		return
+	}
+
+	q := strings.ToLower(query.Get("q"))
+	symbols := index.find(rel, func(symbol *Symbol) bool {
+		return (len(kinds) == 0 || kinds[symbol.Kind]) && strings.Contains(strings.ToLower(symbol.Name), q)
+	})
+
+	// Exact matches first, then prefix matches, then exported symbols, then alphabetical
+	rank := func(symbol *Symbol) int {
+		name := strings.ToLower(symbol.Name)
+		switch {
+		case name == q:
+			return 0
+		case strings.HasPrefix(name, q):
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		a, b := symbols[i], symbols[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.Exported != b.Exported {
+			return a.Exported
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+
+	if len(symbols) > limit {
+		symbols = symbols[:limit]
+	}
+	WriteJSONResponse(w, symbols)
+}
+
+// definitionHandler returns the declarations of name. When the request says which file the name was used
+// in, a declaration in that file comes first, then exported declarations elsewhere.
+func definitionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Param name is required", http.StatusBadRequest)
+		return
+	}
+
+	from := ""
+	if param := r.URL.Query().Get("path"); param != "" {
+		_, rel, err := relWorkspacePath(param)
+		if err != nil {
+			writeWorkspacePathError(w, err)
+			return
+		}
+		from = rel
+	}
+
+	index, err := getSymbolIndex()
+	if err != nil {
+		log.Println("Failed to build symbol index", err.Error())
+		http.Error(w, "Failed to build symbol index", http.StatusInternalServerError)
+		return
+	}
+
+	definitions := index.find("", func(symbol *Symbol) bool {
+		return symbol.Name == name && symbol.Kind != SymbolRoute
+	})
+
+	sort.Slice(definitions, func(i, j int) bool {
+		a, b := definitions[i], definitions[j]
+		if (a.Path == from) != (b.Path == from) {
+			return a.Path == from
+		}
+		if a.Exported != b.Exported {
+			return a.Exported
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+
+	WriteJSONResponse(w, definitions)
+}
+
+type SymbolReference struct {
+	Path         string `json:"path"`
+	Line         int    `json:"line"`
+	Column       int    `json:"column"`
+	Text         string `json:"text"`
+	IsDefinition bool   `json:"isDefinition"`
+}
+
+// referencesHandler finds every whole-word use of name in the JS/TS files of the workspace (or the
+// directory or file in path). It's textual, so a local variable that happens to share the name shows up
+// too.
+func referencesHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Param name is required", http.StatusBadRequest)
+		return
+	}
+
+	_, dir, err := relWorkspacePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	index, err := getSymbolIndex()
+	if err != nil {
+		log.Println("Failed to build symbol index", err.Error())
+		http.Error(w, "Failed to build symbol index", http.StatusInternalServerError)
+		return
+	}
+
+	definitions := make(map[string]bool)
+	for _, symbol := range index.find(dir, func(symbol *Symbol) bool { return symbol.Name == name }) {
+		definitions[symbol.Path+":"+strconv.Itoa(symbol.Line)] = true
+	}
+
+	index.mu.RLock()
+	paths := make([]string, 0, len(index.files))
+	for rel := range index.files {
+		if inScope(rel, dir) {
+			paths = append(paths, rel)
+		}
+	}
+	index.mu.RUnlock()
+	sort.Strings(paths)
+
+	references := make([]*SymbolReference, 0)
+	for _, rel := range paths {
+		content, ok := readSearchableFile(filepath.Join(index.root, filepath.FromSlash(rel)))
+		if !ok {
+			continue
+		}
+
+		for _, reference := range findReferences(rel, content, name) {
+			reference.IsDefinition = definitions[rel+":"+strconv.Itoa(reference.Line)]
+			references = append(references, reference)
+		}
+
+		if len(references) >= DEFAULT_REFERENCES_LIMIT {
+			references = references[:DEFAULT_REFERENCES_LIMIT]
+			break
+		}
+	}
+
+	WriteJSONResponse(w, references)
+}
+
+// isIdentifierRune reports whether r can be part of a JS identifier.
+func isIdentifierRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// findReferences returns every use of name in content that isn't part of a longer identifier. A regexp
+// \b won't do since identifiers like $store or jQuery$ start or end with a non-word character.
+func findReferences(rel string, content []byte, name string) []*SymbolReference {
+	references := make([]*SymbolReference, 0)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+
+		for offset := 0; ; {
+			found := strings.Index(line[offset:], name)
+			if found < 0 {
+				break
+			}
+			start, end := offset+found, offset+found+len(name)
+			offset = end
+
+			before, _ := utf8.DecodeLastRuneInString(line[:start])
+			after, _ := utf8.DecodeRuneInString(line[end:])
+			if (start > 0 && isIdentifierRune(before)) || (end < len(line) && isIdentifierRune(after)) {
+				continue
+			}
+
+			text := line
+			if utf8.RuneCountInString(text) > maxGrepLineLength {
+				text = string([]rune(text)[:maxGrepLineLength])
+			}
+			references = append(references, &SymbolReference{
+				Path:   rel,
+				Line:   i + 1,
+				Column: utf8.RuneCountInString(line[:start]) + 1,
+				Text:   text,
+			})
+		}
+	}
+	return references
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExtractSymbols(t *testing.T) {
+	source := `const express = require('express');
+import React from 'react';
+
+/*
+function commentedOut() {}
+*/
+export default function App({ user }) {
+  return <UserCard user={user} />;
+}
+
+export const UserCard = ({ user }) => <div>{user.name}</div>;
+export const API_URL = process.env.API_URL;
+const useUser = async (id) => fetch(API_URL + id);
+
+export interface User {
+  name: string;
+}
+
+class Store extends React.Component {}
+
+function setup(app) {
+  app.get('/api/users', listUsers);
+  router.post("/api/users/:id", updateUser);
+  axios.get('/api/other');
+}
+
+module.exports.listUsers = function (req, res) {};
+`
+	symbols := extractSymbols("frontend/src/App.tsx", []byte(source))
+
+	found := make(map[string]*Symbol)
+	for _, symbol := range symbols {
+		found[symbol.Name] = symbol
+	}
+	assert.Equal(t, 10, len(symbols))
+
+	assert.Equal(t, SymbolComponent, found["App"].Kind)
+	assert.True(t, found["App"].Exported)
+	assert.Equal(t, 7, found["App"].Line)
+	assert.Equal(t, 25, found["App"].Column)
+	assert.Equal(t, SymbolComponent, found["UserCard"].Kind)
+	assert.Equal(t, SymbolConst, found["API_URL"].Kind)
+	assert.Equal(t, SymbolFunction, found["useUser"].Kind)
+	assert.False(t, found["useUser"].Exported)
+	assert.Equal(t, SymbolInterface, found["User"].Kind)
+	assert.Equal(t, SymbolComponent, found["Store"].Kind)
+	assert.Equal(t, SymbolFunction, found["setup"].Kind)
+	assert.Equal(t, SymbolRoute, found["GET /api/users"].Kind)
+	assert.Equal(t, SymbolRoute, found["POST /api/users/:id"].Kind)
+	assert.Equal(t, SymbolFunction, found["listUsers"].Kind)
+	assert.Nil(t, found["commentedOut"])
+	assert.Nil(t, found["express"])
+	assert.Nil(t, found["GET /api/other"])
+}
+
+func Test_FindReferences(t *testing.T) {
+	source := "const $store = createStore();\nexport { $store, $storeKey };\nwatch($store.count, store);\n"
+
+	references := findReferences("src/store.js", []byte(source), "$store")
+	assert.Equal(t, 3, len(references))
+	assert.Equal(t, 1, references[0].Line)
+	assert.Equal(t, 7, references[0].Column)
+	assert.Equal(t, 2, references[1].Line)
+	assert.Equal(t, 10, references[1].Column)
+	assert.Equal(t, 3, references[2].Line)
+	assert.Equal(t, 7, references[2].Column)
+
+	assert.Equal(t, 1, len(findReferences("src/store.js", []byte(source), "store")))
+	assert.True(t, inScope("src/store.js", "src/store.js"))
+	assert.False(t, inScope("src/store.js/other.js", "src/store"))
+}
@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -44,7 +43,11 @@ func tailLogsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	tailFile = filepath.Join("code", tailFile)
+	tailFile, err = resolveWorkspacePath(tailFile)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
 
 	// 1. Try and read intial_lines number lines from the file and send that in the first websocket message.
 	cmd := exec.Command("tail", "-n", strconv.Itoa(numLines), tailFile)
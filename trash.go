@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Trash entries are kept for a week and the trash as a whole is capped at 1 GB unless
+// FERMAT_TRASH_MAX_AGE_HOURS / FERMAT_TRASH_MAX_BYTES say otherwise. The oldest entries go first.
+const (
+	DEFAULT_TRASH_MAX_AGE_HOURS = 7 * 24
+	DEFAULT_TRASH_MAX_BYTES     = 1 << 30
+)
+
+var trashIDRegex = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+// trashLock guards moving things in and out of the trash as well as expiry.
+var trashLock sync.Mutex
+
+// TrashEntry describes something that was deleted from the workspace. The entry itself is stored in
+// $HOME/.fermat/trash/<id>/item with this metadata next to it in meta.json.
+type TrashEntry struct {
+	ID           string    `json:"id"`
+	OriginalPath string    `json:"originalPath"`
+	DeletedAt    time.Time `json:"deletedAt"`
+	IsDir        bool      `json:"isDir"`
+	Size         int64     `json:"size"`
+}
+
+func trashDir() (string, error) {
+	return fermatStateDir("trash")
+}
+
+// diskUsage adds up the size of every regular file at or underneath path.
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// moveToTrash moves a workspace path into the trash and returns the new entry.
+func moveToTrash(path string) (*TrashEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := trashDir()
+	if err != nil {
+		return nil, err
+	}
+
+	idBytes := make([]byte, 12)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	entry := &TrashEntry{
+		ID:           hex.EncodeToString(idBytes),
+		OriginalPath: path,
+		DeletedAt:    time.Now(),
+		IsDir:        info.IsDir(),
+		Size:         diskUsage(path),
+	}
+
+	trashLock.Lock()
+	defer trashLock.Unlock()
+
+	entryDir := filepath.Join(dir, entry.ID)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return nil, err
+	}
+
+	data, _ := json.Marshal(entry)
+	if err := os.WriteFile(filepath.Join(entryDir, "meta.json"), data, 0644); err != nil {
+		os.RemoveAll(entryDir)
+		return nil, err
+	}
+
+	if err := os.Rename(path, filepath.Join(entryDir, "item")); err != nil {
+		os.RemoveAll(entryDir)
+		return nil, err
+	}
+
+	expireTrashLocked(dir)
+	return entry, nil
+}
+
+// restoreFromTrash moves an entry back to where it was deleted from.
+func restoreFromTrash(entry *TrashEntry) error {
+	dir, err := trashDir()
+	if err != nil {
+		return err
+	}
+
+	trashLock.Lock()
+	defer trashLock.Unlock()
+
+	entryDir := filepath.Join(dir, entry.ID)
+	if err := os.Rename(filepath.Join(entryDir, "item"), entry.OriginalPath); err != nil {
+		return err
+	}
+	return os.RemoveAll(entryDir)
+}
+
+// listTrashLocked returns every entry in the trash, newest first.
+func listTrashLocked(dir string) []*TrashEntry {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	entries := make([]*TrashEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !trashIDRegex.MatchString(dirEntry.Name()) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, dirEntry.Name(), "meta.json"))
+		if err != nil {
+			continue
+		}
+
+		var entry TrashEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt.After(entries[j].DeletedAt) })
+	return entries
+}
+
+// expireTrashLocked purges entries that are too old, then the oldest entries until the trash fits in its
+// size budget. The newest entry always stays until it's too old, even when it's bigger than the whole
+// budget on its own, otherwise deleting a big directory would be permanent right away.
+func expireTrashLocked(dir string) {
+	maxAge := time.Duration(envInt64("FERMAT_TRASH_MAX_AGE_HOURS", DEFAULT_TRASH_MAX_AGE_HOURS)) * time.Hour
+	maxBytes := envInt64("FERMAT_TRASH_MAX_BYTES", DEFAULT_TRASH_MAX_BYTES)
+
+	var total int64
+	for i, entry := range listTrashLocked(dir) {
+		total += entry.Size
+		if time.Since(entry.DeletedAt) > maxAge || (i > 0 && total > maxBytes) {
+			log.Printf("[Info] Purging %s from the trash", entry.OriginalPath)
+			os.RemoveAll(filepath.Join(dir, entry.ID))
+		}
+	}
+}
+
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := trashDir()
+	if err != nil {
+		http.Error(w, "Failed to open trash", http.StatusInternalServerError)
+		return
+	}
+
+	trashLock.Lock()
+	expireTrashLocked(dir)
+	entries := listTrashLocked(dir)
+	trashLock.Unlock()
+
+	WriteJSONResponse(w, entries)
+}
+
+func restoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !trashIDRegex.MatchString(id) {
+		http.Error(w, "Trash entry not found", http.StatusNotFound)
+		return
+	}
+
+	dir, err := trashDir()
+	if err != nil {
+		http.Error(w, "Failed to open trash", http.StatusInternalServerError)
+		return
+	}
+
+	trashLock.Lock()
+	defer trashLock.Unlock()
+
+	entryDir := filepath.Join(dir, id)
+	data, err := os.ReadFile(filepath.Join(entryDir, "meta.json"))
+	if err != nil {
+		http.Error(w, "Trash entry not found", http.StatusNotFound)
+		return
+	}
+
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		http.Error(w, "Trash entry is corrupt", http.StatusInternalServerError)
+		return
+	}
+
+	// Restore to the original location unless the client picks a new one
+	target := r.URL.Query().Get("to")
+	if target == "" {
+		target = entry.OriginalPath
+	}
+	dest, err := resolveWorkspacePath(target)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	if _, err := os.Lstat(dest); err == nil {
+		http.Error(w, "Something already exists at "+dest, http.StatusConflict)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.Rename(filepath.Join(entryDir, "item"), dest); err != nil {
+		http.Error(w, "Failed to restore: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	os.RemoveAll(entryDir)
+
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		http.Error(w, "Failed to load ignore rules", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := listDir(dest, listOptions{Depth: -1, Ignore: ignore})
+	if err != nil {
+		http.Error(w, "Restored but failed to read it back", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, result)
+}
+
+// purgeTrashHandler permanently deletes a single entry, or the whole trash when no id is given.
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := trashDir()
+	if err != nil {
+		http.Error(w, "Failed to open trash", http.StatusInternalServerError)
+		return
+	}
+
+	trashLock.Lock()
+	defer trashLock.Unlock()
+
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		for _, entry := range listTrashLocked(dir) {
+			os.RemoveAll(filepath.Join(dir, entry.ID))
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Trash emptied"))
+		return
+	}
+
+	if !trashIDRegex.MatchString(id) || !fileExists(filepath.Join(dir, id)) {
+		http.Error(w, "Trash entry not found", http.StatusNotFound)
+		return
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, id)); err != nil {
+		http.Error(w, "Failed to purge: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Trash entry purged"))
+}
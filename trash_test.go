@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MoveToTrashKeepsNewestEntry(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("FERMAT_TRASH_MAX_BYTES", "10")
+
+	old := filepath.Join(home, "old.txt")
+	big := filepath.Join(home, "big.txt")
+	assert.Nil(t, os.WriteFile(old, []byte("small"), 0644))
+	assert.Nil(t, os.WriteFile(big, []byte("more than ten bytes"), 0644))
+
+	oldEntry, err := moveToTrash(old)
+	assert.Nil(t, err)
+	bigEntry, err := moveToTrash(big)
+	assert.Nil(t, err)
+
+	dir, err := trashDir()
+	assert.Nil(t, err)
+	entries := listTrashLocked(dir)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, bigEntry.ID, entries[0].ID)
+	assert.NotEqual(t, oldEntry.ID, entries[0].ID)
+
+	assert.Nil(t, restoreFromTrash(bigEntry))
+	assert.True(t, fileExists(big))
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DEFAULT_MAX_UPLOAD_BYTES caps a single upload unless FERMAT_MAX_UPLOAD_BYTES says otherwise.
+const DEFAULT_MAX_UPLOAD_BYTES = 1 << 30
+
+// Sessions that haven't been touched in this long are removed along with their partial data.
+const uploadSessionExpiry = 24 * time.Hour
+
+var uploadIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadSession is persisted as <id>.json next to the <id>.part file holding the bytes received so
+// far. The size of the part file is the authoritative offset, so a session survives both a dropped
+// connection and a fermat restart.
+type uploadSession struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Overwrite bool      `json:"overwrite"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type UploadSessionResponse struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+type CreateUploadSessionRequest struct {
+	// Dir is the workspace directory to upload into, frontend/public when empty.
+	Dir       string `json:"dir"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// Chunks for the same session must be written one at a time
+var (
+	uploadLocksMu sync.Mutex
+	uploadLocks   = make(map[string]*sync.Mutex)
+)
+
+// lockUploadSession locks an existing session. Unknown ids don't get a lock at all, so requests with
+// made up ids can't grow uploadLocks, and removeUploadSession drops the lock when the session ends.
+func lockUploadSession(id string) (func(), bool) {
+	if !uploadSessionExists(id) {
+		return nil, false
+	}
+
+	uploadLocksMu.Lock()
+	lock, ok := uploadLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		uploadLocks[id] = lock
+	}
+	uploadLocksMu.Unlock()
+
+	lock.Lock()
+	// The session may have completed or been aborted while we were waiting
+	if !uploadSessionExists(id) {
+		lock.Unlock()
+		return nil, false
+	}
+	return lock.Unlock, true
+}
+
+func uploadSessionExists(id string) bool {
+	if !uploadIDRegex.MatchString(id) {
+		return false
+	}
+	dir, err := uploadsDir()
+	if err != nil {
+		return false
+	}
+	return fileExists(filepath.Join(dir, id+".json"))
+}
+
+func maxUploadBytes() int64 {
+	return envInt64("FERMAT_MAX_UPLOAD_BYTES", DEFAULT_MAX_UPLOAD_BYTES)
+}
+
+func uploadsDir() (string, error) {
+	return fermatStateDir("uploads")
+}
+
+func loadUploadSession(id string) (*uploadSession, string, error) {
+	if !uploadIDRegex.MatchString(id) {
+		return nil, "", os.ErrNotExist
+	}
+
+	dir, err := uploadsDir()
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var session uploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, "", err
+	}
+	return &session, filepath.Join(dir, id+".part"), nil
+}
+
+func (session *uploadSession) response(partPath string) (*UploadSessionResponse, error) {
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadSessionResponse{
+		ID:     session.ID,
+		Path:   session.Path,
+		Size:   session.Size,
+		Offset: info.Size(),
+	}, nil
+}
+
+func removeUploadSession(id string) {
+	dir, err := uploadsDir()
+	if err != nil {
+		return
+	}
+	os.Remove(filepath.Join(dir, id+".part"))
+	os.Remove(filepath.Join(dir, id+".json"))
+
+	uploadLocksMu.Lock()
+	delete(uploadLocks, id)
+	uploadLocksMu.Unlock()
+}
+
+// expireUploadSessions removes abandoned sessions so partial uploads can't fill up the disk.
+func expireUploadSessions() {
+	dir, err := uploadsDir()
+	if err != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".part")
+		if id == entry.Name() {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > uploadSessionExpiry {
+			log.Printf("[Info] Expiring abandoned upload session %s", id)
+			removeUploadSession(id)
+		}
+	}
+}
+
+func getUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	unlock, ok := lockUploadSession(id)
+	if !ok {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	session, partPath, err := loadUploadSession(id)
+	if err != nil {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	response, err := session.response(partPath)
+	if err != nil {
+		http.Error(w, "Failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, response)
+}
+
+func createUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateUploadSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Filename == "" || filepath.Base(req.Filename) != req.Filename {
+		http.Error(w, "A plain filename must be specified", http.StatusBadRequest)
+		return
+	}
+
+	if req.Size < 0 {
+		http.Error(w, "Size can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	if max := maxUploadBytes(); req.Size > max {
+		http.Error(w, fmt.Sprintf("Upload of %d bytes exceeds the maximum of %d bytes", req.Size, max), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if _, err := hex.DecodeString(req.SHA256); err != nil || len(req.SHA256) != 64 {
+		http.Error(w, "sha256 must be the hex encoded checksum of the whole file", http.StatusBadRequest)
+		return
+	}
+
+	dirPath := req.Dir
+	if dirPath == "" {
+		dirPath = filepath.Join("frontend", "public")
+	}
+
+	path, err := resolveWorkspacePath(filepath.Join(dirPath, req.Filename))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	if !req.Overwrite && fileExists(path) {
+		http.Error(w, "File already exists", http.StatusConflict)
+		return
+	}
+
+	expireUploadSessions()
+
+	dir, err := uploadsDir()
+	if err != nil {
+		http.Error(w, "Failed to create upload directory", http.StatusInternalServerError)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "Failed to create upload session", http.StatusInternalServerError)
+		return
+	}
+
+	session := &uploadSession{
+		ID:        hex.EncodeToString(idBytes),
+		Path:      path,
+		Size:      req.Size,
+		SHA256:    strings.ToLower(req.SHA256),
+		Overwrite: req.Overwrite,
+		CreatedAt: time.Now(),
+	}
+
+	partPath := filepath.Join(dir, session.ID+".part")
+	if err := os.WriteFile(partPath, nil, 0644); err != nil {
+		http.Error(w, "Failed to create upload session", http.StatusInternalServerError)
+		return
+	}
+
+	data, _ := json.Marshal(session)
+	if err := os.WriteFile(filepath.Join(dir, session.ID+".json"), data, 0644); err != nil {
+		os.Remove(partPath)
+		http.Error(w, "Failed to create upload session", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponseWithHeader(w, http.StatusCreated, &UploadSessionResponse{
+		ID:   session.ID,
+		Path: session.Path,
+		Size: session.Size,
+	})
+}
+
+// uploadChunkHandler appends the request body to the session. The offset query parameter must match
+// what the server already has, otherwise the client is told where to resume from with a 409.
+func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	unlock, ok := lockUploadSession(id)
+	if !ok {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	session, partPath, err := loadUploadSession(id)
+	if err != nil {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Param offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	current, err := session.response(partPath)
+	if err != nil {
+		http.Error(w, "Failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+
+	if offset != current.Offset {
+		WriteJSONResponseWithHeader(w, http.StatusConflict, current)
+		return
+	}
+
+	part, err := os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Read one byte more than what's left so an oversized chunk can be detected and cut off.
+	remaining := session.Size - offset
+	written, copyErr := io.Copy(part, io.LimitReader(r.Body, remaining+1))
+	closeErr := part.Close()
+
+	if written > remaining {
+		os.Truncate(partPath, session.Size)
+		http.Error(w, "Chunk goes past the declared size of the upload", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Whatever made it to disk before a dropped connection is kept, the client can resume from there.
+	if copyErr != nil || closeErr != nil {
+		log.Printf("Upload %s interrupted after %d bytes: %v", id, written, errors.Join(copyErr, closeErr))
+	}
+
+	response, err := session.response(partPath)
+	if err != nil {
+		http.Error(w, "Failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, response)
+}
+
+func completeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	unlock, ok := lockUploadSession(id)
+	if !ok {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	session, partPath, err := loadUploadSession(id)
+	if err != nil {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	part, err := os.Open(partPath)
+	if err != nil {
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, part)
+	part.Close()
+	if err != nil {
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+
+	if size != session.Size {
+		http.Error(w, fmt.Sprintf("Upload is incomplete: received %d of %d bytes", size, session.Size), http.StatusConflict)
+		return
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != session.SHA256 {
+		// The data is corrupt so there's no point in resuming, start over.
+		removeUploadSession(id)
+		http.Error(w, fmt.Sprintf("Checksum mismatch: expected %s but got %s", session.SHA256, checksum), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Resolve again in case the workspace changed (e.g. a symlink appeared) while the upload was running.
+	path, err := resolveWorkspacePath(session.Path)
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	if !session.Overwrite && fileExists(path) {
+		http.Error(w, "File already exists", http.StatusConflict)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		http.Error(w, "Failed to create directories", http.StatusInternalServerError)
+		return
+	}
+
+	fileWriteLock.Lock()
+	snapshotBeforeWrite(path)
+	if err := os.Rename(partPath, path); err != nil {
+		fileWriteLock.Unlock()
+		http.Error(w, "Failed to move upload into place: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordFileFromDisk(path, HistoryUpload)
+	fileWriteLock.Unlock()
+	removeUploadSession(id)
+
+	result, err := listDir(path, listOptions{Depth: 0})
+	if err != nil {
+		http.Error(w, "Uploaded file but failed to read it back", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, result)
+}
+
+func abortUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	unlock, ok := lockUploadSession(id)
+	if !ok {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	if _, _, err := loadUploadSession(id); err != nil {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	removeUploadSession(id)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Upload aborted"))
+}
@@ -11,6 +11,8 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/storage"
@@ -18,6 +20,21 @@ import (
 
 const SECRETS_JSON = "SECRETS_JSON"
 
+// envInt64 reads a positive integer from the environment, falling back to def when unset or invalid.
+func envInt64(name string, def int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		log.Printf("[Error] Invalid %s value (%s). Using default value.", name, value)
+		return def
+	}
+	return parsed
+}
+
 // downloadFileFromURL downloads the given file to the local file system
 func downloadFileFromURL(url string, destination string) error {
 	resp, err := http.Get(url)
@@ -178,6 +195,35 @@ func saveBytesToFile(filename string, data []byte) error {
 	return err
 }
 
+// writeFileAtomic writes data to a temp file next to filename and renames it into place so readers never
+// see a half written file. An existing file keeps its permissions, new files are created with 0644.
+func writeFileAtomic(filename string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".fermat-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
 // loadDockerImageFromTarball is a helper function that will docker load -i [tarball] and logs any output
 func loadDockerImageFromTarball(tarballPath string) error {
 	cmd := exec.Command("docker", "load", "--input", tarballPath)
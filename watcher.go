@@ -0,0 +1,362 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Events for the same path that arrive within this window are coalesced into a single event.
+	watchDebounceWindow = 200 * time.Millisecond
+	// Batches a subscriber can fall behind by before batches get dropped
+	watchSubscriberBuffer = 64
+)
+
+type FileEventOp string
+
+const (
+	FileCreated FileEventOp = "create"
+	FileWritten FileEventOp = "write"
+	FileRemoved FileEventOp = "remove"
+	FileRenamed FileEventOp = "rename"
+	// FileResync means events were dropped, the subscriber has to rescan everything underneath Path
+	FileResync FileEventOp = "resync"
+)
+
+type FileEvent struct {
+	Op    FileEventOp `json:"op"`
+	Path  string      `json:"path"`
+	IsDir bool        `json:"isDir"`
+}
+
+// workspaceWatcher recursively watches the code workspace with fsnotify and fans debounced batches of
+// events out to any number of subscribers. Ignored paths (see ignoreMatcher) are neither watched nor
+// reported. There is a single shared instance, see getWorkspaceWatcher.
+type workspaceWatcher struct {
+	root    string
+	ignore  *ignoreMatcher
+	watcher *fsnotify.Watcher
+
+	mu          sync.Mutex
+	dirs        map[string]bool
+	subscribers map[chan []FileEvent]struct{}
+}
+
+var (
+	workspaceWatcherOnce sync.Once
+	sharedWatcher        *workspaceWatcher
+	sharedWatcherErr     error
+)
+
+// getWorkspaceWatcher starts the shared watcher the first time it's needed and returns it afterwards.
+func getWorkspaceWatcher() (*workspaceWatcher, error) {
+	workspaceWatcherOnce.Do(func() {
+		sharedWatcher, sharedWatcherErr = newWorkspaceWatcher()
+	})
+	return sharedWatcher, sharedWatcherErr
+}
+
+func newWorkspaceWatcher() (*workspaceWatcher, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := getWorkspaceIgnore()
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	ww := &workspaceWatcher{
+		root:        root,
+		ignore:      ignore,
+		watcher:     watcher,
+		dirs:        make(map[string]bool),
+		subscribers: make(map[chan []FileEvent]struct{}),
+	}
+	ww.addRecursive(root)
+
+	go ww.run()
+
+	return ww, nil
+}
+
+// Subscribe returns a channel receiving batches of events and a function to stop the subscription.
+// A subscriber that falls behind has batches dropped rather than stalling everyone else, followed by a
+// FileResync event once it catches up.
+func (ww *workspaceWatcher) Subscribe() (<-chan []FileEvent, func()) {
+	// One slot more than the buffer so there's always room for the FileResync event
+	ch := make(chan []FileEvent, watchSubscriberBuffer+1)
+
+	ww.mu.Lock()
+	ww.subscribers[ch] = struct{}{}
+	ww.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			ww.mu.Lock()
+			delete(ww.subscribers, ch)
+			ww.mu.Unlock()
+		})
+	}
+}
+
+func (ww *workspaceWatcher) addRecursive(dir string) {
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != ww.root && ww.ignore.Match(path, true) {
+			return filepath.SkipDir
+		}
+
+		if err := ww.watcher.Add(path); err != nil {
+			log.Printf("[Warn] Failed to watch %s: %v", path, err)
+			return nil
+		}
+
+		ww.mu.Lock()
+		ww.dirs[path] = true
+		ww.mu.Unlock()
+		return nil
+	})
+}
+
+func (ww *workspaceWatcher) run() {
+	pending := make(map[string]*FileEvent)
+	order := make([]string, 0)
+
+	timer := time.NewTimer(watchDebounceWindow)
+	timer.Stop()
+	timerRunning := false
+
+	for {
+		select {
+		case event, ok := <-ww.watcher.Events:
+			if !ok {
+				return
+			}
+
+			fileEvent := ww.translate(event)
+			if fileEvent == nil {
+				continue
+			}
+
+			prev, seen := pending[fileEvent.Path]
+			if !seen {
+				order = append(order, fileEvent.Path)
+			}
+			if merged := mergeFileEvents(prev, fileEvent); merged != nil {
+				pending[fileEvent.Path] = merged
+			} else {
+				delete(pending, fileEvent.Path)
+			}
+
+			// The window starts with the first event so a constant stream of writes can't starve subscribers.
+			if !timerRunning {
+				timer.Reset(watchDebounceWindow)
+				timerRunning = true
+			}
+		case <-timer.C:
+			timerRunning = false
+
+			batch := make([]FileEvent, 0, len(pending))
+			for _, path := range order {
+				if event, ok := pending[path]; ok {
+					batch = append(batch, *event)
+					delete(pending, path)
+				}
+			}
+			order = order[:0]
+
+			if len(batch) > 0 {
+				ww.broadcast(batch)
+			}
+		case err, ok := <-ww.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("[Error] Workspace watcher:", err)
+		}
+	}
+}
+
+// translate converts a raw fsnotify event, keeping the set of watched directories up to date. It returns
+// nil for events nobody should hear about.
+func (ww *workspaceWatcher) translate(event fsnotify.Event) *FileEvent {
+	path := event.Name
+
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil
+		}
+		if ww.ignore.Match(path, info.IsDir()) {
+			return nil
+		}
+		if info.IsDir() {
+			ww.addRecursive(path)
+		}
+		return &FileEvent{Op: FileCreated, Path: path, IsDir: info.IsDir()}
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		ww.mu.Lock()
+		isDir := ww.dirs[path]
+		delete(ww.dirs, path)
+		ww.mu.Unlock()
+
+		if ww.ignore.Match(path, isDir) {
+			return nil
+		}
+		op := FileRemoved
+		if event.Op&fsnotify.Rename != 0 {
+			op = FileRenamed
+		}
+		return &FileEvent{Op: op, Path: path, IsDir: isDir}
+	case event.Op&fsnotify.Write != 0:
+		if ww.ignore.Match(path, false) {
+			return nil
+		}
+		return &FileEvent{Op: FileWritten, Path: path}
+	}
+
+	// Chmod and friends aren't interesting to the IDE
+	return nil
+}
+
+// mergeFileEvents folds next into prev for the same path. A nil result means the two cancel out.
+func mergeFileEvents(prev *FileEvent, next *FileEvent) *FileEvent {
+	if prev == nil {
+		return next
+	}
+
+	switch {
+	case prev.Op == FileCreated && next.Op == FileWritten:
+		return prev
+	case prev.Op == FileCreated && (next.Op == FileRemoved || next.Op == FileRenamed):
+		return nil
+	case (prev.Op == FileRemoved || prev.Op == FileRenamed) && next.Op == FileCreated:
+		// Editors and tools like npm save by replacing the file, from the outside that's just a write.
+		if !next.IsDir {
+			return &FileEvent{Op: FileWritten, Path: next.Path}
+		}
+	}
+	return next
+}
+
+func (ww *workspaceWatcher) broadcast(batch []FileEvent) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+
+	// Only broadcast sends on the channels, so checking the length first can't race
+	for ch := range ww.subscribers {
+		if len(ch) < watchSubscriberBuffer {
+			ch <- batch
+			continue
+		}
+
+		log.Printf("[Warn] Workspace watcher subscriber is falling behind, dropped %d events", len(batch))
+		// Everything dropped from here on happens before the subscriber gets to the resync, so a single
+		// one covers them all
+		select {
+		case ch <- []FileEvent{{Op: FileResync, Path: ww.root, IsDir: true}}:
+		default:
+		}
+	}
+}
+
+func watchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	// Optionally only report events underneath a directory of the workspace
+	scope, err := resolveWorkspacePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeWorkspacePathError(w, err)
+		return
+	}
+
+	watcher, err := getWorkspaceWatcher()
+	if err != nil {
+		log.Println("Failed to start workspace watcher", err.Error())
+		http.Error(w, "Failed to start workspace watcher", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade websocket connection", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	events, unsubscribe := watcher.Subscribe()
+	defer unsubscribe()
+
+	closeReceived := make(chan struct{})
+	go func() {
+		defer close(closeReceived)
+
+		for {
+			messageType, _, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if messageType == websocket.CloseMessage {
+				break
+			}
+		}
+	}()
+
+	clientClosed := r.Context().Done()
+
+	// Ping every 60 seconds checking for dead connection
+	pinger := time.NewTicker(60 * time.Second)
+	defer pinger.Stop()
+
+	for {
+		select {
+		case batch := <-events:
+			scoped := make([]FileEvent, 0, len(batch))
+			for _, event := range batch {
+				// A resync is about the whole workspace, so it's for every client no matter its scope
+				if event.Op == FileResync || isWithinDir(scope, event.Path) {
+					scoped = append(scoped, event)
+				}
+			}
+			if len(scoped) == 0 {
+				continue
+			}
+
+			if err := conn.WriteJSON(scoped); err != nil {
+				log.Println("Error writing to websocket connection", err)
+				return
+			}
+		case <-clientClosed:
+			return
+		case <-pinger.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closeReceived:
+			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			if err != nil {
+				log.Println("Error writing to websocket connection", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WatcherBroadcastResync(t *testing.T) {
+	ww := &workspaceWatcher{root: "/code", subscribers: make(map[chan []FileEvent]struct{})}
+	events, unsubscribe := ww.Subscribe()
+	defer unsubscribe()
+
+	for i := 0; i < watchSubscriberBuffer+10; i++ {
+		ww.broadcast([]FileEvent{{Op: FileWritten, Path: "/code/server.js"}})
+	}
+	assert.Equal(t, watchSubscriberBuffer+1, len(events))
+
+	for i := 0; i < watchSubscriberBuffer; i++ {
+		assert.Equal(t, FileWritten, (<-events)[0].Op)
+	}
+	resync := <-events
+	assert.Equal(t, []FileEvent{{Op: FileResync, Path: "/code", IsDir: true}}, resync)
+
+	// Once it caught up the subscriber gets events again
+	ww.broadcast([]FileEvent{{Op: FileCreated, Path: "/code/app.js"}})
+	assert.Equal(t, FileCreated, (<-events)[0].Op)
+}
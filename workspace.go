@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WorkspacePathError is returned when a client supplied path would resolve to somewhere outside of
+// the user's code workspace. Handlers should surface it as a 403 using writeWorkspacePathError.
+type WorkspacePathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *WorkspacePathError) Error() string {
+	return fmt.Sprintf("path %q is not allowed: %s", e.Path, e.Reason)
+}
+
+// workspaceRoot returns the absolute, symlink resolved path to the user's code workspace ($HOME/code).
+func workspaceRoot() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	root := filepath.Join(home, "code")
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return root, nil
+		}
+		return "", err
+	}
+
+	return resolved, nil
+}
+
+// fermatStateDir returns (and creates) a directory under $HOME/.fermat for fermat's own bookkeeping. It
+// lives next to the workspace rather than inside it so it never gets committed with the user's code, but
+// on the same volume so files can be renamed between the two.
+func fermatStateDir(parts ...string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(append([]string{home, ".fermat"}, parts...)...)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// resolveWorkspacePath turns a client supplied path into an absolute path inside the workspace. Relative
+// paths are joined onto the workspace root, and so are paths with a leading slash like "/backend" (see
+// workspaceRelativePath). Absolute paths that already point inside the workspace, which is what listDir
+// hands out in File.Path, are taken as they are. Anything that climbs out with "..", or escapes through a
+// symlink results in a *WorkspacePathError.
+func resolveWorkspacePath(path string) (string, error) {
+	root, err := workspaceRoot()
+	if err != nil {
+		return "", err
+	}
+	return resolvePathInRoot(root, workspaceRelativePath(root, path))
+}
+
+// workspaceRelativePath strips the leading slash clients put on workspace relative paths, unless path is
+// an absolute path inside root already.
+func workspaceRelativePath(root string, path string) string {
+	if filepath.IsAbs(path) && !isWithinDir(root, filepath.Clean(path)) {
+		return strings.TrimLeft(path, "/")
+	}
+	return path
+}
+
+func resolvePathInRoot(root string, path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", &WorkspacePathError{Path: path, Reason: "contains a NUL byte"}
+	}
+
+	var candidate string
+	if filepath.IsAbs(path) {
+		candidate = filepath.Clean(path)
+		if !isWithinDir(root, candidate) {
+			return "", &WorkspacePathError{Path: path, Reason: "absolute path outside of the workspace"}
+		}
+	} else {
+		for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+			if part == ".." {
+				return "", &WorkspacePathError{Path: path, Reason: "path traversal is not allowed"}
+			}
+		}
+		candidate = filepath.Join(root, path)
+	}
+
+	if candidate == root {
+		return root, nil
+	}
+
+	// Only the parents are resolved. The last component stays as it is so deleting or moving a symlink
+	// acts on the link rather than on whatever it points to.
+	parent, err := resolveExistingPrefix(root, filepath.Dir(candidate), path)
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(parent, filepath.Base(candidate))
+
+	// Reading or writing through the link still reaches its target, which has to be in the workspace too.
+	// That includes dangling links, writing to one would create the target.
+	info, err := os.Lstat(resolved)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return resolved, nil
+	}
+	target, err := filepath.EvalSymlinks(resolved)
+	if os.IsNotExist(err) {
+		link, err := os.Readlink(resolved)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(parent, link)
+		}
+		target, err = resolveExistingPrefix(root, filepath.Clean(link), path)
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if !isWithinDir(root, target) {
+		return "", &WorkspacePathError{Path: path, Reason: "symlink points outside of the workspace"}
+	}
+	return resolved, nil
+}
+
+// resolveExistingPrefix resolves symlinks in candidate, which (or some of its parents) may not exist yet
+// when we're about to create it. Symlinks are resolved on the deepest ancestor that does exist, which must
+// still live in the workspace.
+func resolveExistingPrefix(root string, candidate string, path string) (string, error) {
+	existing := candidate
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !isWithinDir(root, resolved) {
+				return "", &WorkspacePathError{Path: path, Reason: "symlink points outside of the workspace"}
+			}
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return candidate, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// isWithinDir reports whether path is dir itself or lives somewhere underneath it. Both must be clean.
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// writeWorkspacePathError responds with a 403 for workspace violations and a 500 for anything else.
+func writeWorkspacePathError(w http.ResponseWriter, err error) {
+	var pathErr *WorkspacePathError
+	if errors.As(err, &pathErr) {
+		http.Error(w, pathErr.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Failed to resolve path: "+err.Error(), http.StatusInternalServerError)
+}
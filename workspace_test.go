@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResolvePathInRoot(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	outside, _ := filepath.EvalSymlinks(t.TempDir())
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "backend"), 0755))
+	assert.Nil(t, os.Symlink(outside, filepath.Join(root, "escape")))
+
+	path, err := resolvePathInRoot(root, "backend/server.js")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "backend", "server.js"), path)
+
+	path, err = resolvePathInRoot(root, filepath.Join(root, "backend"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "backend"), path)
+
+	for _, bad := range []string{"../fermat-keys.json", "backend/../../.config", "/etc/passwd", "escape/secrets.json"} {
+		_, err = resolvePathInRoot(root, bad)
+		var pathErr *WorkspacePathError
+		assert.True(t, errors.As(err, &pathErr), bad)
+	}
+}
+
+func Test_ResolvePathInRootSymlinks(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	outside, _ := filepath.EvalSymlinks(t.TempDir())
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "src"), 0755))
+	assert.Nil(t, os.Symlink(filepath.Join(root, "src"), filepath.Join(root, "link")))
+	assert.Nil(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	assert.Nil(t, os.Symlink(filepath.Join(outside, "missing.txt"), filepath.Join(root, "dangling")))
+	assert.Nil(t, os.Symlink("src/new.txt", filepath.Join(root, "pending")))
+
+	// The link itself, not its target, so deleting link doesn't delete src
+	path, err := resolvePathInRoot(root, "link")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "link"), path)
+
+	// Parents are still resolved
+	path, err = resolvePathInRoot(root, "link/app.js")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "src", "app.js"), path)
+
+	path, err = resolvePathInRoot(root, "pending")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "pending"), path)
+
+	for _, bad := range []string{"escape", "dangling"} {
+		_, err = resolvePathInRoot(root, bad)
+		var pathErr *WorkspacePathError
+		assert.True(t, errors.As(err, &pathErr), bad)
+	}
+}
+
+func Test_ResolveWorkspacePathLeadingSlash(t *testing.T) {
+	home, _ := filepath.EvalSymlinks(t.TempDir())
+	t.Setenv("HOME", home)
+	root := filepath.Join(home, "code")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "backend"), 0755))
+
+	for _, path := range []string{"backend", "/backend", filepath.Join(root, "backend")} {
+		resolved, err := resolveWorkspacePath(path)
+		assert.Nil(t, err, path)
+		assert.Equal(t, filepath.Join(root, "backend"), resolved, path)
+	}
+
+	_, err := resolveWorkspacePath("/../etc/passwd")
+	var pathErr *WorkspacePathError
+	assert.True(t, errors.As(err, &pathErr))
+}